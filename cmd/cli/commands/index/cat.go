@@ -27,7 +27,7 @@ func catAction(args []string, options map[string]string) int {
 		return 1
 	}
 
-	index, err := ipfsIndexer.RetrieveIndex(ctx)
+	index, _, err := ipfsIndexer.RetrieveIndex(ctx)
 	if err != nil {
 		fmt.Println(err)
 		return 1
@@ -27,7 +27,7 @@ func purgeAction(args []string, options map[string]string) int {
 		return 1
 	}
 
-	err = ipfsIndexer.SaveIndex(ctx, map[string]metadata.RepoMetadata{})
+	_, err = ipfsIndexer.SaveIndex(ctx, map[string]metadata.RepoMetadata{})
 	if err != nil {
 		fmt.Println(err)
 		return 1
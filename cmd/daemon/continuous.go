@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/scheduler"
+)
+
+// RunContinuous keeps the mirrors up to date: the ranking list is fetched
+// again every refreshInterval and the repositories are processed whenever
+// the scheduler considers them due. It returns when ctx is cancelled, once
+// the running repositories are rolled back, or if the run itself fails.
+func (p *Pipeline) RunContinuous(ctx context.Context, sched *scheduler.Scheduler, clock scheduler.Clock, refreshInterval time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pool, err := p.startWorkers(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = p.runRounds(ctx, cancel, sched, clock, refreshInterval, pool)
+
+	// The pending updates are published even if the run failed.
+	closeErr := pool.close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to publish the index: %w", closeErr)
+	}
+
+	return nil
+}
+
+// runRounds processes the due repositories round after round until ctx is
+// cancelled.
+func (p *Pipeline) runRounds(ctx context.Context, cancel context.CancelFunc, sched *scheduler.Scheduler, clock scheduler.Clock, refreshInterval time.Duration, pool *workerPool) error {
+	pending := p.pendingJobs()
+
+	var lastRefresh time.Time
+	for ctx.Err() == nil {
+		if lastRefresh.IsZero() || !clock.Now().Before(lastRefresh.Add(refreshInterval)) {
+			err := p.refreshRanking(ctx, sched, pool.writer)
+			if ctx.Err() != nil {
+				break
+			}
+			if err != nil && lastRefresh.IsZero() {
+				return err
+			}
+			if err != nil {
+				log.Printf("keep the previous repository list: %s", err)
+			}
+
+			lastRefresh = clock.Now()
+		}
+
+		tasks := sched.Due()
+
+		jobs := pending
+		pending = nil
+		for _, task := range tasks {
+			jobs = append(jobs, job{link: task.Link, force: task.Force})
+		}
+
+		if len(jobs) > 0 {
+			log.Printf("start a round of %d repositories", len(jobs))
+
+			d := newDispatcher(p, pool.writer)
+			d.scheduled = true
+
+			err := d.enqueue(jobs...)
+			if err != nil {
+				return err
+			}
+
+			err = d.run(ctx, cancel, pool.jobs, pool.results)
+			if err != nil {
+				return err
+			}
+
+			d.summary.Interrupted = ctx.Err() != nil
+			d.summary.Log()
+
+			// Only the successful checks are recorded, the failed and
+			// interrupted repositories keep their history and are retried
+			// after the check interval.
+			for _, task := range tasks {
+				if mirrored, ok := d.done[task.Link]; ok {
+					sched.Done(task.Link, mirrored)
+				} else {
+					sched.Release(task.Link)
+				}
+			}
+
+			continue
+		}
+
+		wake := lastRefresh.Add(refreshInterval)
+		if next, ok := sched.NextRun(); ok && next.Before(wake) {
+			wake = next
+		}
+
+		log.Printf("next run at %s", wake.Format(time.RFC3339))
+		select {
+		case <-clock.After(wake.Sub(clock.Now())):
+		case <-ctx.Done():
+		}
+	}
+
+	return nil
+}
+
+// refreshRanking gives the ranking list to the scheduler. The repositories
+// unknown by the scheduler start with the history saved inside the state
+// and the index.
+func (p *Pipeline) refreshRanking(ctx context.Context, sched *scheduler.Scheduler, writer *indexWriter) error {
+	log.Printf("fetch the repository list")
+	links, err := p.MetaSource.FetchLinks(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the repository list: %w", err)
+	}
+
+	repos := make([]scheduler.Repo, 0, len(links))
+	for i, link := range links {
+		repo := scheduler.Repo{Link: link, Rank: i + 1}
+
+		if state, ok := p.State.Get(link); ok {
+			repo.LastCheck = state.LastSuccess
+		}
+
+		if entry, ok := writer.Get(link); ok {
+			repo.LastMirror = entry.LastGitFetch
+		}
+
+		repos = append(repos, repo)
+	}
+
+	sched.SetRepos(repos)
+
+	return nil
+}
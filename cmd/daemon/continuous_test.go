@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/Peltoche/ipfs-gh1000/pkg/scheduler"
+	"github.com/ipfs/go-cid"
+)
+
+// fakeSource lists a fixed ranking.
+type fakeSource struct {
+	links []string
+}
+
+func (s *fakeSource) FetchLinks(ctx context.Context) ([]string, error) {
+	return append([]string{}, s.links...), nil
+}
+
+func (s *fakeSource) FetchMetadataForLink(ctx context.Context, link string) (*metadata.RepoMetadata, error) {
+	return &metadata.RepoMetadata{}, nil
+}
+
+func (f *fakeProcessor) count(link string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.attempts[link])
+}
+
+func TestPipelineRunRounds(t *testing.T) {
+	start := time.Date(2022, 4, 5, 11, 40, 0, 0, time.UTC)
+	clock := scheduler.NewFakeClock(start)
+	sched := scheduler.New(clock, scheduler.Options{CheckInterval: time.Hour})
+
+	p := newTestPipeline(t)
+	p.MetaSource = &fakeSource{links: []string{"owner/ok", "owner/broken"}}
+	p.RetryBackoff = time.Millisecond
+	failure := errors.New("invalid repository")
+
+	processor := newFakeProcessor(func(j job, attempt int) jobResult {
+		if j.link == "owner/broken" {
+			return jobResult{job: j, err: failure}
+		}
+
+		return jobResult{job: j}
+	})
+
+	store := newFakeIndexStore(t)
+	pool := &workerPool{
+		writer:  newIndexWriter(store, map[string]metadata.RepoMetadata{}, cid.Undef, 0, 0, store.onPublished),
+		jobs:    make(chan job),
+		results: make(chan jobResult),
+	}
+	processor.start(pool.jobs, pool.results)
+	defer close(pool.jobs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- p.runRounds(ctx, cancel, sched, clock, 24*time.Hour, pool)
+	}()
+
+	// waitRound waits for the end of the round in which owner/ok is
+	// processed for the nth time.
+	waitRound := func(n int) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			idle := processor.count("owner/ok") >= n
+			for _, entry := range sched.Queue() {
+				idle = idle && !entry.Running
+			}
+
+			if idle {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d not completed", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitRound(1)
+
+	// The failed repository isn't retried during the round, it's released
+	// to the scheduler.
+	if count := processor.count("owner/broken"); count != 1 {
+		t.Errorf("expected a single attempt, got %d", count)
+	}
+
+	for _, entry := range sched.Queue() {
+		switch entry.Link {
+		case "owner/ok":
+			if !entry.LastCheck.Equal(start) {
+				t.Errorf("expected owner/ok to be checked, got %+v", entry)
+			}
+		case "owner/broken":
+			if !entry.LastCheck.IsZero() || !entry.LastAttempt.Equal(start) || !entry.NextRun.Equal(start.Add(time.Hour)) {
+				t.Errorf("expected owner/broken to be retried after the check interval, got %+v", entry)
+			}
+		}
+	}
+
+	// Nothing is processed before the check interval.
+	clock.Advance(30 * time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if processor.count("owner/ok") != 1 || processor.count("owner/broken") != 1 {
+		t.Errorf("expected nothing to be processed before the check interval")
+	}
+
+	// The failed repository is retried with the next rounds, then
+	// quarantined.
+	for round := 2; round <= 4; round++ {
+		clock.Advance(time.Hour)
+		waitRound(round)
+	}
+
+	if count := processor.count("owner/broken"); count != p.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d", p.MaxAttempts, count)
+	}
+
+	repo, _ := p.State.Get("owner/broken")
+	if !repo.Quarantined() || repo.Attempts != p.MaxAttempts {
+		t.Errorf("expected owner/broken to be quarantined, got %+v", repo)
+	}
+
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rounds didn't stop")
+	}
+}
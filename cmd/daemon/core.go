@@ -1,98 +1,599 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"reflect"
 	"time"
 
 	"github.com/Peltoche/ipfs-gh1000/pkg/git"
 	"github.com/Peltoche/ipfs-gh1000/pkg/ipfs"
 	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
-	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/Peltoche/ipfs-gh1000/pkg/state"
+	"github.com/Peltoche/ipfs-gh1000/pkg/workspace"
 	"github.com/go-git/go-git/v5/plumbing/cache"
 	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/ipfs/go-cid"
 )
 
-func Run(
-	metaFetcher *metadata.Fetcher,
-	gitFetcher *git.Fetcher,
-	unpacker *git.Unpacker,
-	infoUpdater *git.ServerInfoUpdater,
-	ipfsUploader *ipfs.Uploader,
-	indexer *ipfs.Indexer,
-) error {
-	ctx := context.Background()
-
-	log.Printf("fetch first page")
-	links, err := metaFetcher.FetchLinkPage(ctx)
+type Pipeline struct {
+	MetaSource     metadata.RankingSource
+	Workspaces     *workspace.Manager
+	GitFetcher     *git.Fetcher
+	Unpacker       *git.Unpacker
+	InfoUpdater    *git.ServerInfoUpdater
+	Sanitizer      *git.Sanitizer
+	Verifier       *git.Verifier // optional
+	IpfsUploader   *ipfs.Uploader
+	IpfsDownloader *ipfs.Downloader
+	Indexer        *ipfs.Indexer
+
+	// The index is published every IndexFlushInterval or once
+	// IndexFlushEvery repositories are updated, and at the end of the run.
+	// Zero disables the trigger.
+	IndexFlushInterval time.Duration
+	IndexFlushEvery    int
+
+	LFSFetcher *git.LFSFetcher       // optional
+	Bundler    *git.Bundler          // optional
+	Submodules *git.SubmoduleScanner // optional
+	// SubmoduleDepth is the maximum nesting level of the mirrored submodules.
+	SubmoduleDepth int
+
+	Concurrency Concurrency
+
+	State *state.Store
+	// FreshnessWindow is the duration during which a successfully mirrored
+	// repository is not processed again. Zero disables it.
+	FreshnessWindow time.Duration
+
+	// MaxAttempts is the number of failed attempts after which a
+	// repository is quarantined, they are spaced by an exponential backoff
+	// starting at RetryBackoff.
+	MaxAttempts  int
+	RetryBackoff time.Duration
+	// QuarantineDuration is the duration after which a quarantined
+	// repository is processed again. Zero means forever.
+	QuarantineDuration time.Duration
+}
+
+// Concurrency limits the number of repositories processed in parallel and,
+// among them, the number of repositories inside each kind of stage. A zero
+// value means 1.
+type Concurrency struct {
+	Workers int
+	Network int // metadata, git and LFS fetches
+	CPU     int // unpack, sanitize, bundles, server info and verification
+	IPFS    int // downloads and uploads from/to the IPFS node
+}
+
+// job is a repository to mirror.
+type job struct {
+	link string
+	// repoURL is only set for the submodules, they are not listed by the
+	// ranking source so their metadatas are limited to their url.
+	repoURL string
+	depth   int
+	// force publishes a new version even if the upstream repository didn't
+	// change.
+	force bool
+}
+
+type jobResult struct {
+	job     job
+	skipped bool // the upstream repository didn't change
+	err     error
+}
+
+// Run mirrors all the repositories listed by the ranking source. A
+// repository failure doesn't stop the run, it's reported inside the returned
+// summary.
+//
+// Cancelling ctx stops the run: the repositories being processed are rolled
+// back and stay pending for the next run.
+func (p *Pipeline) Run(ctx context.Context) (*Summary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	log.Printf("fetch the repository list")
+	links, err := p.MetaSource.FetchLinks(ctx)
 	if err != nil {
-		log.Fatalf("failed to fetch the first page: %s", err)
+		return nil, fmt.Errorf("failed to fetch the repository list: %w", err)
 	}
 
 	src := rand.NewSource(time.Now().UnixNano())
 	r := rand.New(src)
-	for i := range links {
-		n := r.Intn(len(links) - 1)
-		links[i], links[n] = links[n], links[i]
+	r.Shuffle(len(links), func(i, j int) {
+		links[i], links[j] = links[j], links[i]
+	})
+
+	pool, err := p.startWorkers(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	d := newDispatcher(p, pool.writer)
+
+	pending := p.pendingJobs()
 	for _, link := range links {
-		fs := memfs.New()
-		storage := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+		pending = append(pending, job{link: link})
+	}
+
+	err = d.enqueue(pending...)
+	if err == nil {
+		err = d.run(ctx, cancel, pool.jobs, pool.results)
+	}
+
+	// The pending updates are published even if the run failed.
+	closeErr := pool.close()
+	if err != nil {
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, fmt.Errorf("failed to publish the index: %w", closeErr)
+	}
+
+	d.summary.Interrupted = ctx.Err() != nil
+
+	return d.summary, nil
+}
+
+// workerPool runs the stages of the jobs sent by the dispatcher.
+type workerPool struct {
+	writer  *indexWriter
+	jobs    chan job
+	results chan jobResult
+}
+
+// startWorkers retrieves the index and starts the workers, they stop once
+// close is called.
+func (p *Pipeline) startWorkers(ctx context.Context) (*workerPool, error) {
+	log.Println("retrieve the index")
+	index, indexCID, err := p.Indexer.RetrieveIndex(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the index: %w", err)
+	}
+
+	pool := &workerPool{
+		writer:  newIndexWriter(p.Indexer, index, indexCID, p.IndexFlushInterval, p.IndexFlushEvery, p.State.Succeed),
+		jobs:    make(chan job),
+		results: make(chan jobResult),
+	}
+
+	go pool.writer.run()
+
+	limits := newStageLimits(p.Concurrency)
+
+	for i := 0; i < atLeastOne(p.Concurrency.Workers); i++ {
+		go func() {
+			for j := range pool.jobs {
+				skipped, err := p.processRepo(ctx, j, pool.writer, limits)
+				pool.results <- jobResult{j, skipped, err}
+			}
+		}()
+	}
+
+	return pool, nil
+}
+
+// close stops the workers and publishes the pending index updates. The
+// running jobs must be completed.
+func (w *workerPool) close() error {
+	close(w.jobs)
+
+	return w.writer.close()
+}
+
+// pendingJobs returns the jobs left pending by the previous run.
+func (p *Pipeline) pendingJobs() []job {
+	pending := []job{}
+	for _, repo := range p.State.Pending() {
+		pending = append(pending, job{link: repo.Link, repoURL: repo.RepoURL, depth: repo.Depth})
+	}
+	if len(pending) > 0 {
+		log.Printf("resume %d pending repositories", len(pending))
+	}
+
+	return pending
+}
+
+// build is the state of a repository going through the stages.
+type build struct {
+	job          job
+	meta         *metadata.RepoMetadata
+	prev         metadata.RepoMetadata
+	hasPrev      bool
+	ws           *workspace.Workspace
+	storage      *filesystem.Storage
+	nbLFSObjects int
+	// skipped is set by the stages when the upstream repository didn't
+	// change since the last mirror.
+	skipped bool
+}
+
+// stage is a step of the processing of a repository, limit bounds the number
+// of repositories running it.
+type stage struct {
+	name  string
+	limit limiter
+	run   func(ctx context.Context, b *build) error
+}
+
+// unpinner removes the versions which failed to be published, it's
+// implemented by ipfs.Uploader.
+type unpinner interface {
+	Unpin(ctx context.Context, c cid.Cid) error
+}
+
+// processRepo runs all the stages for a repository. It returns true if the
+// repository is skipped as unchanged since the last mirror.
+func (p *Pipeline) processRepo(ctx context.Context, j job, writer *indexWriter, limits *stageLimits) (bool, error) {
+	stages := []stage{
+		{"metadata", limits.network, p.fetchMetadata},
+		{"download", limits.ipfs, p.prepareWorkspace},
+		{"fetch", limits.network, p.fetchRepository},
+		{"build", limits.cpu, p.buildRepository},
+		{"upload", limits.ipfs, p.uploadRepository},
+	}
+
+	return p.runStages(ctx, j, writer, stages, p.IpfsUploader)
+}
+
+// runStages runs the stages in order then adds the repository to the index.
+// If a stage fails, the version uploaded by the previous ones is unpinned.
+func (p *Pipeline) runStages(ctx context.Context, j job, writer *indexWriter, stages []stage, uploader unpinner) (bool, error) {
+	b := &build{job: j}
+	b.prev, b.hasPrev = writer.Get(j.link)
+	b.hasPrev = b.hasPrev && b.prev.Repo != nil
+
+	published := false
+	defer func() {
+		if !published {
+			rollback(b, writer, uploader)
+		}
+
+		if b.ws == nil {
+			return
+		}
+
+		err := b.ws.Close()
+		if err != nil {
+			log.Printf("%s: failed to cleanup the workspace: %s", j.link, err)
+		}
+	}()
+
+	for _, stage := range stages {
+		err := p.State.SetStage(j.link, stage.name)
+		if err != nil {
+			return false, fmt.Errorf("failed to save the state: %w", err)
+		}
+
+		err = stage.limit.run(ctx, func() error {
+			return stage.run(ctx, b)
+		})
+		if err != nil {
+			return false, &stageError{stage.name, err}
+		}
+
+		if b.skipped {
+			break
+		}
+	}
+
+	// The repository stays in the index stage until the index containing
+	// it is published, the writer then marks it as done.
+	err := p.State.SetStage(j.link, "index")
+	if err != nil {
+		return false, fmt.Errorf("failed to save the state: %w", err)
+	}
+
+	if b.skipped {
+		// The refreshed metadatas are published with the previous version.
+		writer.Update(j.link, b.unchangedMeta())
+		published = true
+		return true, nil
+	}
+
+	log.Printf("%s: add the new version to the index", j.link)
+	writer.Update(j.link, *b.meta)
+	published = true
+
+	return false, nil
+}
+
+// rollbackTimeout bounds the cleanup of a failed repository. It doesn't use
+// the run context which may be cancelled.
+const rollbackTimeout = time.Minute
+
+// rollback unpins the version uploaded by a repository which failed to be
+// published.
+func rollback(b *build, writer *indexWriter, uploader unpinner) {
+	if b.meta == nil || b.meta.Repo == nil {
+		return
+	}
+
+	// An identical content gives the same CID, the one of the previous
+	// version or of another repository (a mirror and its fork), which must
+	// stay pinned.
+	if writer.References(*b.meta.Repo) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	log.Printf("%s: unpin the unpublished version %s", b.job.link, b.meta.Repo)
+	err := uploader.Unpin(ctx, *b.meta.Repo)
+	if err != nil {
+		log.Printf("%s: %s", b.job.link, err)
+	}
+}
 
+// stageError is the failure of a repository during a stage.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s stage: %s", e.stage, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func (p *Pipeline) fetchMetadata(ctx context.Context, b *build) error {
+	link := b.job.link
+
+	b.meta = &metadata.RepoMetadata{
+		RepositoryURL:     b.job.repoURL,
+		LastMetadataFetch: time.Now(),
+	}
+	if b.job.repoURL == "" {
 		log.Printf("fetch metadata for %s", link)
-		meta, err := metaFetcher.FetchMetadataForLink(ctx, link)
+		var err error
+		b.meta, err = p.MetaSource.FetchMetadataForLink(ctx, link)
 		if err != nil {
-			log.Fatalf("failed to fetch the metadatas for %s: %s", link, err)
+			return fmt.Errorf("failed to fetch the metadatas: %w", err)
+		}
+	}
+
+	log.Printf("start converting the repo %s", b.meta.RepositoryURL)
+
+	if b.hasPrev && !b.job.force {
+		upstream, err := p.GitFetcher.FetchUpstreamHead(ctx, b.meta.RepositoryURL)
+		if errors.Is(err, git.ErrEmptyRepository) {
+			log.Printf("upstream repository is empty, skip %s", link)
+			b.skipped = true
+			return nil
 		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch the upstream HEAD: %w", err)
+		}
+
+		rawRefs, err := p.IpfsDownloader.ReadFile(ctx, *b.prev.Repo, "info/refs")
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the previous references: %w", err)
+		}
+
+		prevRefs, err := git.ParseInfoRefs(bytes.NewReader(rawRefs))
+		if err != nil {
+			return fmt.Errorf("invalid previous references: %w", err)
+		}
+
+		if upstream.Head.String() == b.prev.Head && upstream.DefaultBranch.Short() == b.prev.DefaultBranch &&
+			reflect.DeepEqual(upstream.PublishedRefs, prevRefs) {
+			log.Printf("upstream refs didn't move since the last mirror, skip %s", link)
+			b.skipped = true
+		}
+	}
 
-		log.Printf("start converting the repo %s", meta.RepositoryURL)
+	return nil
+}
+
+// unchangedMeta returns the refreshed metadatas of a skipped repository
+// completed with its previous version.
+func (b *build) unchangedMeta() metadata.RepoMetadata {
+	meta := *b.meta
+
+	meta.Head = b.prev.Head
+	meta.LastGitFetch = b.prev.LastGitFetch
+	meta.Repo = b.prev.Repo
+	meta.LFS = b.prev.LFS
+	meta.Submodules = b.prev.Submodules
+	meta.Bundles = b.prev.Bundles
+	if meta.DefaultBranch == "" {
+		meta.DefaultBranch = b.prev.DefaultBranch
+	}
+
+	return meta
+}
+
+// prepareWorkspace creates the workspace and retrieves the previous version
+// of the repository into it.
+func (p *Pipeline) prepareWorkspace(ctx context.Context, b *build) error {
+	var err error
+
+	b.ws, err = p.Workspaces.Create(b.job.link, int64(b.meta.SizeKB)*1024)
+	if err != nil {
+		return fmt.Errorf("failed to create the workspace: %w", err)
+	}
+
+	b.storage = filesystem.NewStorage(b.ws.FS, cache.NewObjectLRUDefault())
 
-		log.Printf("start pulling repository...")
-		err = gitFetcher.CloneRepositoryInto(ctx, meta.RepositoryURL, storage)
+	if b.hasPrev {
+		log.Printf("%s: retrieve the previous version %s", b.job.link, b.prev.Repo)
+		err = p.IpfsDownloader.DownloadRepo(ctx, *b.prev.Repo, b.ws.FS)
 		if err != nil {
-			log.Fatalf("failed to clone the repository: %s", err)
+			return fmt.Errorf("failed to retrieve the previous version: %w", err)
 		}
-		log.Println("pull successfull")
+	}
+
+	return nil
+}
+
+func (p *Pipeline) fetchRepository(ctx context.Context, b *build) error {
+	link := b.job.link
+	meta := b.meta
+
+	log.Printf("%s: start pulling repository...", link)
+	fetchRes, err := p.GitFetcher.FetchRepositoryInto(ctx, meta.RepositoryURL, b.storage)
+	if errors.Is(err, git.ErrEmptyRepository) {
+		// There is nothing to mirror, the previous version, if any, stays
+		// published.
+		log.Printf("upstream repository is empty, skip %s", link)
+		b.skipped = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch the repository: %w", err)
+	}
+	log.Printf("%s: pull successfull, %d refs mirrored", link, len(fetchRes.Refs))
+
+	if b.hasPrev && !fetchRes.Changed && !b.job.force {
+		log.Printf("nothing changed since the last mirror, skip %s", link)
+		b.skipped = true
+		return nil
+	}
 
-		log.Println("unpack repository...")
-		err = unpacker.Unpack(storage.Filesystem())
+	meta.LastGitFetch = time.Now()
+	meta.Head = fetchRes.Head.String()
+	if meta.DefaultBranch == "" {
+		meta.DefaultBranch = fetchRes.DefaultBranch.Short()
+	}
+
+	if p.LFSFetcher != nil {
+		log.Printf("%s: fetch the LFS objects", link)
+		b.nbLFSObjects, err = p.LFSFetcher.FetchObjects(ctx, meta.RepositoryURL, b.storage)
 		if err != nil {
-			log.Fatalf("failed to unpack the repository: %s", err)
+			return fmt.Errorf("failed to fetch the LFS objects: %w", err)
 		}
-		log.Println("unpack successfull")
+	}
+
+	return nil
+}
 
-		log.Println("start updating server infos")
-		err = infoUpdater.UpdateServerInfo(storage)
+func (p *Pipeline) buildRepository(ctx context.Context, b *build) error {
+	link := b.job.link
+	meta := b.meta
+	storage := b.storage
+
+	if p.Submodules != nil {
+		log.Printf("%s: scan the submodules", link)
+		submodules, err := p.Submodules.Scan(storage, meta.RepositoryURL)
 		if err != nil {
-			log.Fatalf("failed to update the server infos: %s", err)
+			return fmt.Errorf("failed to scan the submodules: %w", err)
+		}
+		log.Printf("%s: %d submodules found", link, len(submodules))
+
+		meta.Submodules = make(map[string]*cid.Cid, len(submodules))
+		for _, submoduleURL := range submodules {
+			meta.Submodules[submoduleURL] = nil
 		}
-		log.Println("server info updating successfull")
+	}
 
-		log.Println("start ipfs uploading")
-		repoCID, err := ipfsUploader.UploadRepo(ctx, fs)
+	log.Printf("%s: unpack repository...", link)
+	err := p.Unpacker.Unpack(ctx, storage)
+	if err != nil {
+		return fmt.Errorf("failed to unpack the repository: %w", err)
+	}
+	log.Printf("%s: unpack successfull", link)
+
+	log.Printf("%s: sanitize the repository", link)
+	description := fmt.Sprintf("Mirror of %s", meta.RepositoryURL)
+	if meta.Description != "" {
+		description += ": " + meta.Description
+	}
+
+	err = p.Sanitizer.Sanitize(storage, description)
+	if err != nil {
+		return fmt.Errorf("failed to sanitize the repository: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if p.Bundler != nil {
+		log.Printf("%s: write the bundles", link)
+		err = p.Bundler.WriteBundles(ctx, storage, meta.LastGitFetch)
 		if err != nil {
-			log.Fatalf("failed to upload the repo %q into ipfs: %s", meta.RepositoryURL, err)
+			return fmt.Errorf("failed to write the bundles: %w", err)
 		}
-		log.Printf("ifps uploading successfull: %q", repoCID)
+	}
 
-		meta.Repo = repoCID
+	log.Printf("%s: start updating server infos", link)
+	err = p.InfoUpdater.UpdateServerInfo(ctx, storage)
+	if err != nil {
+		return fmt.Errorf("failed to update the server infos: %w", err)
+	}
+	log.Printf("%s: server info updating successfull", link)
 
-		log.Println("start updating the index")
-		index, err := indexer.RetrieveIndex(ctx)
+	if p.Verifier != nil {
+		log.Printf("%s: verify the repository", link)
+		err = p.Verifier.Verify(ctx, storage)
 		if err != nil {
-			log.Fatalf("failed to retrieve the index: %s", err)
+			return fmt.Errorf("the repository is broken: %w", err)
 		}
+		log.Printf("%s: verification successfull", link)
+	}
+
+	return nil
+}
+
+func (p *Pipeline) uploadRepository(ctx context.Context, b *build) error {
+	link := b.job.link
+	meta := b.meta
+
+	log.Printf("%s: start ipfs uploading", link)
+	repoCID, err := p.IpfsUploader.UploadRepo(ctx, b.ws.FS)
+	if err != nil {
+		return fmt.Errorf("failed to upload the repo %q into ipfs: %w", meta.RepositoryURL, err)
+	}
+	log.Printf("%s: ifps uploading successfull: %q", link, repoCID)
+
+	meta.Repo = repoCID
 
-		log.Printf("index: %#v\n\n", index)
-		index[link] = *meta
+	// A repository which dropped LFS doesn't publish any LFS directory.
+	meta.LFS = nil
+	if b.nbLFSObjects > 0 {
+		meta.LFS, err = p.IpfsUploader.ResolvePath(ctx, *repoCID, git.LFSObjectsDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve the LFS objects directory: %w", err)
+		}
+	}
 
-		err = indexer.SaveIndex(ctx, index)
+	if p.Bundler != nil {
+		meta.Bundles, err = p.IpfsUploader.ListDir(ctx, *repoCID, git.BundlesDir)
 		if err != nil {
-			log.Fatalf("failed to save the new index: %s", err)
+			return fmt.Errorf("failed to list the bundles: %w", err)
 		}
 	}
 
 	return nil
 }
+
+// submoduleLink returns the clone url and the link of a submodule.
+func submoduleLink(submoduleURL string) (string, string, error) {
+	cloneURL, err := git.SubmoduleCloneURL(submoduleURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	link, err := metadata.LinkForRepositoryURL(cloneURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	repoURL, err := metadata.RepositoryURLForLink(link)
+	if err != nil {
+		return "", "", err
+	}
+
+	return repoURL, link, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/Peltoche/ipfs-gh1000/pkg/state"
+	"github.com/Peltoche/ipfs-gh1000/pkg/workspace"
+	"github.com/ipfs/go-cid"
+)
+
+// fakeUnpinner records the unpinned versions.
+type fakeUnpinner struct {
+	lock     sync.Mutex
+	unpinned []cid.Cid
+}
+
+func (u *fakeUnpinner) Unpin(ctx context.Context, c cid.Cid) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.unpinned = append(u.unpinned, c)
+
+	return nil
+}
+
+// newTestPipeline returns a pipeline with a state containing the given
+// pending repositories.
+func newTestPipeline(t *testing.T, links ...string) *Pipeline {
+	t.Helper()
+
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repos := []state.RepoState{}
+	for _, link := range links {
+		repos = append(repos, state.RepoState{Link: link})
+	}
+
+	err = store.Enqueue(repos...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Pipeline{State: store, MaxAttempts: 3}
+}
+
+func TestPipelineRunStages(t *testing.T) {
+	versionCID := newTestCID(t, "version")
+	prevCID := newTestCID(t, "previous")
+	stageErr := errors.New("stage failure")
+
+	// upload simulates the upload of the version into a workspace.
+	upload := func(manager *workspace.Manager, c cid.Cid) func(ctx context.Context, b *build) error {
+		return func(ctx context.Context, b *build) error {
+			var err error
+			b.ws, err = manager.Create(b.job.link, 0)
+			if err != nil {
+				return err
+			}
+
+			b.meta = &metadata.RepoMetadata{Repo: &c}
+
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name      string
+		index     map[string]metadata.RepoMetadata
+		version   cid.Cid
+		failure   error // returned by the stage following the upload
+		published bool
+		unpinned  []cid.Cid
+		stage     string
+	}{
+		{
+			name:      "success",
+			index:     map[string]metadata.RepoMetadata{},
+			version:   versionCID,
+			published: true,
+			stage:     "index",
+		},
+		{
+			name:     "failure after the upload",
+			index:    map[string]metadata.RepoMetadata{},
+			version:  versionCID,
+			failure:  stageErr,
+			unpinned: []cid.Cid{versionCID},
+			stage:    "check",
+		},
+		{
+			// The uploaded content is the one of the previous version, it
+			// must stay pinned.
+			name:    "failure with the previous version",
+			index:   map[string]metadata.RepoMetadata{"owner/repo": {Repo: &prevCID}},
+			version: prevCID,
+			failure: stageErr,
+			stage:   "check",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPipeline(t, "owner/repo")
+			limits := newStageLimits(Concurrency{})
+			uploader := &fakeUnpinner{}
+			store := newFakeIndexStore(t)
+			writer := newIndexWriter(store, test.index, cid.Undef, 0, 0, store.onPublished)
+
+			root := t.TempDir()
+			manager, err := workspace.NewManager(root, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stages := []stage{
+				{"upload", limits.ipfs, upload(manager, test.version)},
+				{"check", limits.cpu, func(ctx context.Context, b *build) error { return test.failure }},
+			}
+
+			skipped, err := p.runStages(context.Background(), job{link: "owner/repo"}, writer, stages, uploader)
+			if !errors.Is(err, test.failure) {
+				t.Fatalf("expected %v, got %v", test.failure, err)
+			}
+
+			if skipped {
+				t.Errorf("expected the repository not to be skipped")
+			}
+
+			var stageErr *stageError
+			if test.failure != nil && (!errors.As(err, &stageErr) || stageErr.stage != "check") {
+				t.Errorf("expected a failure of the check stage, got %v", err)
+			}
+
+			if _, published := writer.pending["owner/repo"]; published != test.published {
+				t.Errorf("expected published to be %t", test.published)
+			}
+
+			if len(uploader.unpinned) != len(test.unpinned) || (len(test.unpinned) > 0 && !uploader.unpinned[0].Equals(test.unpinned[0])) {
+				t.Errorf("expected %v to be unpinned, got %v", test.unpinned, uploader.unpinned)
+			}
+
+			repo, _ := p.State.Get("owner/repo")
+			if repo.Stage != test.stage {
+				t.Errorf("expected the stage %q, got %q", test.stage, repo.Stage)
+			}
+
+			// The workspace is removed in every case.
+			entries, err := os.ReadDir(root)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("expected the workspace to be removed, got %v, %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestPipelineRunStagesSkipped(t *testing.T) {
+	p := newTestPipeline(t, "owner/repo")
+	limits := newStageLimits(Concurrency{})
+	store := newFakeIndexStore(t)
+	prevCID := newTestCID(t, "previous")
+	writer := newIndexWriter(store, map[string]metadata.RepoMetadata{
+		"owner/repo": {Repo: &prevCID, Head: "abcd"},
+	}, cid.Undef, 0, 0, store.onPublished)
+
+	ran := false
+	stages := []stage{
+		{"metadata", limits.network, func(ctx context.Context, b *build) error {
+			b.meta = &metadata.RepoMetadata{Description: "refreshed"}
+			b.skipped = true
+			return nil
+		}},
+		{"fetch", limits.network, func(ctx context.Context, b *build) error {
+			ran = true
+			return nil
+		}},
+	}
+
+	skipped, err := p.runStages(context.Background(), job{link: "owner/repo"}, writer, stages, &fakeUnpinner{})
+	if err != nil || !skipped {
+		t.Fatalf("expected the repository to be skipped, got %t, %v", skipped, err)
+	}
+
+	if ran {
+		t.Errorf("expected the stages after the skip not to run")
+	}
+
+	// The refreshed metadatas are published with the previous version.
+	entry, _ := writer.Get("owner/repo")
+	if entry.Description != "refreshed" || entry.Repo == nil || !entry.Repo.Equals(prevCID) || entry.Head != "abcd" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
+
+func TestPipelineRunStagesCancel(t *testing.T) {
+	p := newTestPipeline(t, "owner/repo")
+	limits := newStageLimits(Concurrency{})
+	uploader := &fakeUnpinner{}
+	store := newFakeIndexStore(t)
+	writer := newIndexWriter(store, map[string]metadata.RepoMetadata{}, cid.Undef, 0, 0, store.onPublished)
+	versionCID := newTestCID(t, "version")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	ran := false
+	stages := []stage{
+		{"upload", limits.ipfs, func(ctx context.Context, b *build) error {
+			b.meta = &metadata.RepoMetadata{Repo: &versionCID}
+			return nil
+		}},
+		{"build", limits.cpu, func(ctx context.Context, b *build) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{"last", limits.cpu, func(ctx context.Context, b *build) error {
+			ran = true
+			return nil
+		}},
+	}
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err := p.runStages(ctx, job{link: "owner/repo"}, writer, stages, uploader)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if ran {
+		t.Errorf("expected the stages after the cancellation not to run")
+	}
+
+	if _, ok := writer.Get("owner/repo"); ok {
+		t.Errorf("expected the repository not to be published")
+	}
+
+	if len(uploader.unpinned) != 1 || !uploader.unpinned[0].Equals(versionCID) {
+		t.Errorf("expected the uploaded version to be unpinned, got %v", uploader.unpinned)
+	}
+
+	// The repository stays pending at the interrupted stage.
+	repo, _ := p.State.Get("owner/repo")
+	if !repo.Pending() || repo.Stage != "build" {
+		t.Errorf("expected the repository to stay pending in the build stage, got %+v", repo)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/state"
+)
+
+// maxRetryBackoff caps the delay between two attempts on a repository.
+const maxRetryBackoff = time.Hour
+
+// Summary counts the outcome of the repositories handled by a run.
+type Summary struct {
+	Mirrored    int
+	Unchanged   int // the upstream repository didn't change
+	Fresh       int // skipped, mirrored during the freshness window
+	Quarantined int // skipped, quarantined by a previous run
+	// Failed associates the repositories quarantined during this run with
+	// their last error.
+	Failed map[string]error
+	// Interrupted is set when the run was stopped before the end of the
+	// queue, the remaining repositories are resumed by the next run.
+	Interrupted bool
+}
+
+// Log prints the summary and the failures.
+func (s *Summary) Log() {
+	log.Printf("run summary: %d mirrored, %d unchanged, %d skipped as fresh, %d skipped as quarantined, %d failed",
+		s.Mirrored, s.Unchanged, s.Fresh, s.Quarantined, len(s.Failed))
+
+	links := make([]string, 0, len(s.Failed))
+	for link := range s.Failed {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+
+	for _, link := range links {
+		log.Printf("failed: %s: %s", link, s.Failed[link])
+	}
+
+	if s.Interrupted {
+		log.Printf("run interrupted, the pending repositories will be resumed by the next run")
+	}
+}
+
+// ExitCode returns the exit code of a run: 0 if every repository succeeded,
+// 2 if some of them failed and 3 if the run was interrupted before the end of
+// the queue, whatever the failures.
+func (s *Summary) ExitCode() int {
+	if s.Interrupted {
+		return 3
+	}
+
+	if len(s.Failed) > 0 {
+		return 2
+	}
+
+	return 0
+}
+
+type retry struct {
+	job job
+	at  time.Time
+}
+
+// dispatcher owns the queue. It feeds the workers and handles their results:
+// the failed repositories are retried with an exponential backoff, unless
+// scheduled, then quarantined and the discovered submodules are appended to
+// the queue.
+type dispatcher struct {
+	p       *Pipeline
+	writer  *indexWriter
+	queue   []job
+	queued  map[string]struct{}
+	retries []retry // sorted by date
+	summary *Summary
+
+	// scheduled is set when the scheduler decides when the repositories are
+	// processed: the freshness window doesn't apply and the failed
+	// repositories are not retried during the round, the scheduler
+	// processes them again after its check interval.
+	scheduled bool
+	// done associates the succeeded repositories with true if a new version
+	// was published.
+	done map[string]bool
+}
+
+func newDispatcher(p *Pipeline, writer *indexWriter) *dispatcher {
+	return &dispatcher{
+		p:       p,
+		writer:  writer,
+		queued:  map[string]struct{}{},
+		summary: &Summary{Failed: map[string]error{}},
+		done:    map[string]bool{},
+	}
+}
+
+// enqueue appends the jobs to the queue, except the ones already queued or
+// which must be skipped.
+func (d *dispatcher) enqueue(jobs ...job) error {
+	repos := []state.RepoState{}
+
+	for _, j := range jobs {
+		if _, ok := d.queued[j.link]; ok || d.skip(j.link) {
+			continue
+		}
+
+		d.queued[j.link] = struct{}{}
+		d.queue = append(d.queue, j)
+		repos = append(repos, state.RepoState{Link: j.link, RepoURL: j.repoURL, Depth: j.depth})
+	}
+
+	err := d.p.State.Enqueue(repos...)
+	if err != nil {
+		return fmt.Errorf("failed to save the queue: %w", err)
+	}
+
+	return nil
+}
+
+// skip returns true if the repository was mirrored during the freshness
+// window or is still quarantined.
+func (d *dispatcher) skip(link string) bool {
+	repo, ok := d.p.State.Get(link)
+	if !ok {
+		return false
+	}
+
+	if repo.Quarantined() {
+		if d.p.QuarantineDuration > 0 && time.Since(repo.LastAttempt) >= d.p.QuarantineDuration {
+			return false
+		}
+
+		log.Printf("%s is quarantined (%s), skip it", link, repo.LastError)
+		d.summary.Quarantined++
+
+		return true
+	}
+
+	if !d.scheduled && d.p.FreshnessWindow > 0 && !repo.Pending() && time.Since(repo.LastSuccess) < d.p.FreshnessWindow {
+		log.Printf("%s mirrored at %s, skip it", link, repo.LastSuccess.Format(time.RFC3339))
+		d.summary.Fresh++
+
+		return true
+	}
+
+	return false
+}
+
+// run dispatches the jobs until the queue and the retries are empty. A
+// non-nil error means the state can't be saved anymore, the run stops once
+// the running jobs are completed. The run stops the same way when ctx is
+// cancelled, without error.
+func (d *dispatcher) run(ctx context.Context, cancel context.CancelFunc, jobs chan<- job, results <-chan jobResult) error {
+	var runErr error
+	running := 0
+
+	for {
+		stopping := runErr != nil || ctx.Err() != nil
+		if running == 0 && (stopping || (len(d.queue) == 0 && len(d.retries) == 0)) {
+			break
+		}
+
+		now := time.Now()
+		for len(d.retries) > 0 && !d.retries[0].at.After(now) {
+			d.queue = append(d.queue, d.retries[0].job)
+			d.retries = d.retries[1:]
+		}
+
+		var next chan<- job
+		var head job
+		if len(d.queue) > 0 && !stopping {
+			next = jobs
+			head = d.queue[0]
+		}
+
+		// Wake up on the cancellation, the loop then waits for the running
+		// jobs only.
+		var done <-chan struct{}
+		if !stopping {
+			done = ctx.Done()
+		}
+
+		// Wake up for the next retry if nothing else can happen before.
+		var retryTimer *time.Timer
+		var retryC <-chan time.Time
+		if len(d.queue) == 0 && len(d.retries) > 0 && !stopping {
+			retryTimer = time.NewTimer(time.Until(d.retries[0].at))
+			retryC = retryTimer.C
+		}
+
+		select {
+		case next <- head:
+			d.queue = d.queue[1:]
+			running++
+		case res := <-results:
+			running--
+
+			err := d.handle(res)
+			if err != nil && runErr == nil {
+				runErr = err
+				cancel()
+			}
+		case <-retryC:
+		case <-done:
+		}
+
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+	}
+
+	return runErr
+}
+
+func (d *dispatcher) handle(res jobResult) error {
+	link := res.job.link
+
+	switch {
+	case res.err == nil:
+		// The state is marked as done by the index writer, once the
+		// update is published.
+		d.done[link] = !res.skipped
+		if res.skipped {
+			d.summary.Unchanged++
+		} else {
+			d.summary.Mirrored++
+		}
+
+		return d.enqueueSubmodules(res.job)
+
+	case errors.Is(res.err, context.Canceled):
+		// Interrupted by the end of the run, it stays pending without
+		// counting an attempt.
+		return nil
+	}
+
+	attempts, err := d.p.State.Fail(link, res.err)
+	if err != nil {
+		return fmt.Errorf("failed to save the state of %s: %w", link, err)
+	}
+
+	if attempts >= d.p.MaxAttempts {
+		log.Printf("%s failed %d times, quarantine it: %s", link, attempts, res.err)
+		d.summary.Failed[link] = res.err
+
+		err = d.p.State.Quarantine(link)
+		if err != nil {
+			return fmt.Errorf("failed to save the state of %s: %w", link, err)
+		}
+
+		return nil
+	}
+
+	if d.scheduled {
+		log.Printf("%s failed (attempt %d/%d), release it to the scheduler: %s", link, attempts, d.p.MaxAttempts, res.err)
+		return nil
+	}
+
+	backoff := d.p.RetryBackoff << (attempts - 1)
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+
+	log.Printf("%s failed (attempt %d/%d), retry in %s: %s", link, attempts, d.p.MaxAttempts, backoff, res.err)
+
+	d.retries = append(d.retries, retry{res.job, time.Now().Add(backoff)})
+	sort.SliceStable(d.retries, func(i, j int) bool {
+		return d.retries[i].at.Before(d.retries[j].at)
+	})
+
+	return nil
+}
+
+func (d *dispatcher) enqueueSubmodules(parent job) error {
+	if d.p.Submodules == nil || parent.depth >= d.p.SubmoduleDepth {
+		return nil
+	}
+
+	jobs := []job{}
+
+	entry, _ := d.writer.Get(parent.link)
+	for submoduleURL := range entry.Submodules {
+		cloneURL, link, err := submoduleLink(submoduleURL)
+		if err != nil {
+			log.Printf("skip the submodule %q of %s: %s", submoduleURL, parent.link, err)
+			continue
+		}
+
+		jobs = append(jobs, job{link: link, repoURL: cloneURL, depth: parent.depth + 1})
+	}
+
+	return d.enqueue(jobs...)
+}
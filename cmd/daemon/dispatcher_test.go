@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/ipfs/go-cid"
+)
+
+// fakeProcessor replaces the workers: it gives each job to process and
+// records the date of every attempt.
+type fakeProcessor struct {
+	process func(j job, attempt int) jobResult
+
+	lock     sync.Mutex
+	attempts map[string][]time.Time
+}
+
+func newFakeProcessor(process func(j job, attempt int) jobResult) *fakeProcessor {
+	return &fakeProcessor{process: process, attempts: map[string][]time.Time{}}
+}
+
+func (f *fakeProcessor) start(jobs <-chan job, results chan<- jobResult) {
+	go func() {
+		for j := range jobs {
+			f.lock.Lock()
+			f.attempts[j.link] = append(f.attempts[j.link], time.Now())
+			attempt := len(f.attempts[j.link])
+			f.lock.Unlock()
+
+			results <- f.process(j, attempt)
+		}
+	}()
+}
+
+// runDispatcher processes the links with the fake processor until the queue
+// is empty.
+func runDispatcher(t *testing.T, p *Pipeline, processor *fakeProcessor, links ...string) *dispatcher {
+	t.Helper()
+
+	store := newFakeIndexStore(t)
+	d := newDispatcher(p, newIndexWriter(store, map[string]metadata.RepoMetadata{}, cid.Undef, 0, 0, store.onPublished))
+
+	jobs := []job{}
+	for _, link := range links {
+		jobs = append(jobs, job{link: link})
+	}
+
+	err := d.enqueue(jobs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	jobsC := make(chan job)
+	defer close(jobsC)
+	results := make(chan jobResult)
+	processor.start(jobsC, results)
+
+	err = d.run(ctx, cancel, jobsC, results)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if ctx.Err() != nil {
+		t.Fatal("the dispatcher didn't complete")
+	}
+
+	return d
+}
+
+func TestDispatcherRetry(t *testing.T) {
+	p := newTestPipeline(t)
+	p.RetryBackoff = 20 * time.Millisecond
+	failure := errors.New("upstream unavailable")
+
+	processor := newFakeProcessor(func(j job, attempt int) jobResult {
+		if j.link == "owner/flaky" && attempt < 3 {
+			return jobResult{job: j, err: failure}
+		}
+
+		return jobResult{job: j, skipped: j.link == "owner/unchanged"}
+	})
+
+	d := runDispatcher(t, p, processor, "owner/flaky", "owner/unchanged")
+
+	if d.summary.Mirrored != 1 || d.summary.Unchanged != 1 || len(d.summary.Failed) != 0 {
+		t.Errorf("unexpected summary %+v", d.summary)
+	}
+
+	if code := d.summary.ExitCode(); code != 0 {
+		t.Errorf("expected the exit code 0, got %d", code)
+	}
+
+	// The backoff doubles after each attempt.
+	attempts := processor.attempts["owner/flaky"]
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+
+	if delay := attempts[1].Sub(attempts[0]); delay < p.RetryBackoff {
+		t.Errorf("expected the first retry after %s, got %s", p.RetryBackoff, delay)
+	}
+
+	if delay := attempts[2].Sub(attempts[1]); delay < 2*p.RetryBackoff {
+		t.Errorf("expected the second retry after %s, got %s", 2*p.RetryBackoff, delay)
+	}
+
+	repo, _ := p.State.Get("owner/flaky")
+	if repo.Attempts != 2 || repo.LastError != failure.Error() {
+		t.Errorf("expected 2 failed attempts, got %+v", repo)
+	}
+}
+
+func TestDispatcherQuarantine(t *testing.T) {
+	p := newTestPipeline(t)
+	p.RetryBackoff = time.Millisecond
+	failure := errors.New("invalid repository")
+
+	processor := newFakeProcessor(func(j job, attempt int) jobResult {
+		if j.link == "owner/broken" {
+			return jobResult{job: j, err: failure}
+		}
+
+		return jobResult{job: j}
+	})
+
+	d := runDispatcher(t, p, processor, "owner/broken", "owner/repo")
+
+	if len(processor.attempts["owner/broken"]) != p.MaxAttempts {
+		t.Errorf("expected %d attempts, got %d", p.MaxAttempts, len(processor.attempts["owner/broken"]))
+	}
+
+	if d.summary.Mirrored != 1 || !errors.Is(d.summary.Failed["owner/broken"], failure) {
+		t.Errorf("unexpected summary %+v", d.summary)
+	}
+
+	if code := d.summary.ExitCode(); code != 2 {
+		t.Errorf("expected the exit code 2, got %d", code)
+	}
+
+	repo, _ := p.State.Get("owner/broken")
+	if !repo.Quarantined() {
+		t.Errorf("expected the repository to be quarantined, got %+v", repo)
+	}
+
+	// The next run skips the quarantined repository.
+	d = runDispatcher(t, p, processor, "owner/broken")
+
+	if d.summary.Quarantined != 1 || len(processor.attempts["owner/broken"]) != p.MaxAttempts {
+		t.Errorf("expected the quarantined repository to be skipped, got %+v", d.summary)
+	}
+}
+
+func TestDispatcherCanceledJob(t *testing.T) {
+	p := newTestPipeline(t)
+
+	processor := newFakeProcessor(func(j job, attempt int) jobResult {
+		return jobResult{job: j, err: &stageError{"fetch", context.Canceled}}
+	})
+
+	d := runDispatcher(t, p, processor, "owner/repo")
+
+	// An interrupted job isn't an attempt, it stays pending.
+	repo, _ := p.State.Get("owner/repo")
+	if repo.Attempts != 0 || !repo.Pending() {
+		t.Errorf("expected the repository to stay pending without attempt, got %+v", repo)
+	}
+
+	if len(d.summary.Failed) != 0 || len(processor.attempts["owner/repo"]) != 1 {
+		t.Errorf("unexpected summary %+v", d.summary)
+	}
+}
+
+func TestSummaryExitCode(t *testing.T) {
+	failed := map[string]error{"owner/repo": errors.New("failure")}
+
+	tests := []struct {
+		name     string
+		summary  Summary
+		expected int
+	}{
+		{"success", Summary{Mirrored: 2, Unchanged: 1}, 0},
+		{"failures", Summary{Mirrored: 2, Failed: failed}, 2},
+		{"interrupted", Summary{Interrupted: true}, 3},
+		{"interrupted with failures", Summary{Failed: failed, Interrupted: true}, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := test.summary.ExitCode(); code != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, code)
+			}
+		})
+	}
+}
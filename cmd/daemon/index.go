@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/ipfs/go-cid"
+)
+
+// indexSaveTimeout bounds the save of the index. The saves don't use the
+// run context: once started, an index is always published completely, even
+// during a shutdown.
+const indexSaveTimeout = 10 * time.Minute
+
+// indexStore publishes the versions of the index, it's implemented by
+// ipfs.Indexer.
+type indexStore interface {
+	SaveIndex(ctx context.Context, index map[string]metadata.RepoMetadata) (cid.Cid, error)
+	UnpinIndex(ctx context.Context, indexCID cid.Cid) error
+}
+
+// indexWriter owns the in-memory index. The updates are applied immediately
+// and published in batch by a single goroutine, every flushInterval or once
+// flushEvery updates are pending, and a last time by close.
+//
+// Only the last published version of the index stays pinned. The updated
+// repositories are given to onPublished once a version containing them is
+// published.
+type indexWriter struct {
+	indexer       indexStore
+	flushInterval time.Duration // zero disables the periodic flushes
+	flushEvery    int           // zero disables the flushes by count
+	onPublished   func(links ...string) error
+
+	flushReq chan struct{}
+	stop     chan struct{}
+	stopped  chan error
+
+	lock      sync.RWMutex
+	index     map[string]metadata.RepoMetadata
+	dirty     int     // number of updates not published yet
+	published cid.Cid // the pinned version, cid.Undef if unknown
+	// pending associates the updated repositories not given to onPublished
+	// yet with the number of their last update.
+	pending map[string]int
+	updates int
+	// dependents associates each link with the entries using it as a
+	// submodule, only them are resolved again when it's updated.
+	dependents map[string]map[string]struct{}
+}
+
+func newIndexWriter(indexer indexStore, index map[string]metadata.RepoMetadata, published cid.Cid, flushInterval time.Duration, flushEvery int, onPublished func(links ...string) error) *indexWriter {
+	w := &indexWriter{
+		indexer:       indexer,
+		flushInterval: flushInterval,
+		flushEvery:    flushEvery,
+		onPublished:   onPublished,
+		flushReq:      make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		stopped:       make(chan error, 1),
+		index:         index,
+		published:     published,
+		pending:       map[string]int{},
+		dependents:    map[string]map[string]struct{}{},
+	}
+
+	for link, entry := range index {
+		w.addDependents(link, entry)
+		w.resolveSubmodules(entry)
+	}
+
+	return w
+}
+
+// Get returns a copy of the entry for link.
+func (w *indexWriter) Get(link string) (metadata.RepoMetadata, bool) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	entry, ok := w.index[link]
+
+	return copyEntry(entry), ok
+}
+
+// References returns true if an index entry points to the repository c.
+func (w *indexWriter) References(c cid.Cid) bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	for _, entry := range w.index {
+		if entry.Repo != nil && entry.Repo.Equals(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Update sets the entry for link. It's published by the next flush.
+func (w *indexWriter) Update(link string, meta metadata.RepoMetadata) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if prev, ok := w.index[link]; ok {
+		w.removeDependents(link, prev)
+	}
+
+	w.index[link] = meta
+	w.addDependents(link, meta)
+	w.resolveSubmodules(meta)
+
+	for dependent := range w.dependents[link] {
+		w.resolveSubmodules(w.index[dependent])
+	}
+
+	w.dirty++
+	w.updates++
+	w.pending[link] = w.updates
+
+	if w.flushEvery > 0 && w.dirty >= w.flushEvery {
+		select {
+		case w.flushReq <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run publishes the updates until close is called.
+func (w *indexWriter) run() {
+	var tick <-chan time.Time
+	if w.flushInterval > 0 {
+		ticker := time.NewTicker(w.flushInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-w.flushReq:
+		case <-w.stop:
+			w.stopped <- w.flush()
+			return
+		}
+
+		err := w.flush()
+		if err != nil {
+			log.Printf("%s, retry with the next flush", err)
+		}
+	}
+}
+
+// flush publishes the index if it has pending updates, then unpins the
+// previous version and gives the published repositories to onPublished.
+func (w *indexWriter) flush() error {
+	w.lock.RLock()
+	dirty := w.dirty
+	pending := make(map[string]int, len(w.pending))
+	for link, update := range w.pending {
+		pending[link] = update
+	}
+	snapshot := make(map[string]metadata.RepoMetadata, len(w.index))
+	for link, entry := range w.index {
+		snapshot[link] = copyEntry(entry)
+	}
+	w.lock.RUnlock()
+
+	if dirty > 0 {
+		err := w.publish(snapshot, dirty)
+		if err != nil {
+			return fmt.Errorf("failed to publish the index: %w", err)
+		}
+	}
+
+	// The repositories updated again since the snapshot wait for the next
+	// flush.
+	links := []string{}
+	w.lock.RLock()
+	for link, update := range pending {
+		if w.pending[link] == update {
+			links = append(links, link)
+		}
+	}
+	w.lock.RUnlock()
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	// If it fails, the repositories are given again by the next flush.
+	err := w.onPublished(links...)
+	if err != nil {
+		return fmt.Errorf("failed to mark the published repositories: %w", err)
+	}
+
+	w.lock.Lock()
+	for _, link := range links {
+		if w.pending[link] == pending[link] {
+			delete(w.pending, link)
+		}
+	}
+	w.lock.Unlock()
+
+	return nil
+}
+
+// publish saves the snapshot of the index containing dirty updates, then
+// unpins the previous version.
+func (w *indexWriter) publish(snapshot map[string]metadata.RepoMetadata, dirty int) error {
+	log.Printf("publish the index with %d new updates", dirty)
+
+	ctx, cancel := context.WithTimeout(context.Background(), indexSaveTimeout)
+	defer cancel()
+
+	indexCID, err := w.indexer.SaveIndex(ctx, snapshot)
+	if err != nil {
+		w.unpinUnpublished(indexCID)
+		return err
+	}
+
+	w.lock.Lock()
+	w.dirty -= dirty
+	prev := w.published
+	w.published = indexCID
+	w.lock.Unlock()
+
+	if prev.Defined() && !prev.Equals(indexCID) {
+		err = w.indexer.UnpinIndex(ctx, prev)
+		if err != nil {
+			log.Printf("failed to unpin the previous index: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// unpinUnpublished unpins a version pinned by a failed save, unless it's the
+// published one: an identical content gives the same CID.
+func (w *indexWriter) unpinUnpublished(indexCID cid.Cid) {
+	w.lock.RLock()
+	published := w.published
+	w.lock.RUnlock()
+
+	if !indexCID.Defined() || indexCID.Equals(published) {
+		return
+	}
+
+	// The save context may be expired.
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	err := w.indexer.UnpinIndex(ctx, indexCID)
+	if err != nil {
+		log.Printf("failed to unpin the unpublished index: %s", err)
+	}
+}
+
+// close stops the periodic flushes and publishes the pending updates.
+func (w *indexWriter) close() error {
+	close(w.stop)
+
+	return <-w.stopped
+}
+
+// resolveSubmodules fills the submodule CIDs of entry with the mirrors
+// present in the index.
+func (w *indexWriter) resolveSubmodules(entry metadata.RepoMetadata) {
+	for submoduleURL := range entry.Submodules {
+		_, link, err := submoduleLink(submoduleURL)
+		if err != nil {
+			continue
+		}
+
+		if mirror, ok := w.index[link]; ok && mirror.Repo != nil {
+			entry.Submodules[submoduleURL] = mirror.Repo
+		}
+	}
+}
+
+func (w *indexWriter) addDependents(link string, entry metadata.RepoMetadata) {
+	for submoduleURL := range entry.Submodules {
+		_, submodule, err := submoduleLink(submoduleURL)
+		if err != nil {
+			continue
+		}
+
+		if w.dependents[submodule] == nil {
+			w.dependents[submodule] = map[string]struct{}{}
+		}
+		w.dependents[submodule][link] = struct{}{}
+	}
+}
+
+func (w *indexWriter) removeDependents(link string, entry metadata.RepoMetadata) {
+	for submoduleURL := range entry.Submodules {
+		_, submodule, err := submoduleLink(submoduleURL)
+		if err != nil {
+			continue
+		}
+
+		delete(w.dependents[submodule], link)
+		if len(w.dependents[submodule]) == 0 {
+			delete(w.dependents, submodule)
+		}
+	}
+}
+
+// copyEntry returns a copy of entry which doesn't share its maps.
+func copyEntry(entry metadata.RepoMetadata) metadata.RepoMetadata {
+	entry.Submodules = copyCIDMap(entry.Submodules)
+	entry.Bundles = copyCIDMap(entry.Bundles)
+
+	return entry
+}
+
+func copyCIDMap(m map[string]*cid.Cid) map[string]*cid.Cid {
+	if m == nil {
+		return nil
+	}
+
+	res := make(map[string]*cid.Cid, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+
+	return res
+}
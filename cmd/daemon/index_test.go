@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/ipfs/go-cid"
+)
+
+func newTestCID(t *testing.T, content string) cid.Cid {
+	t.Helper()
+
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: 0x12, MhLength: -1}.Sum([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// fakeIndexStore records the saved versions of the index, each one gets the
+// CID of its number of entries.
+type fakeIndexStore struct {
+	t   *testing.T
+	err error
+	// publishErr fails the saves once the version is pinned.
+	publishErr error
+
+	lock      sync.Mutex
+	saved     []map[string]metadata.RepoMetadata
+	unpinned  []cid.Cid
+	published [][]string
+	saves     chan struct{}
+}
+
+func newFakeIndexStore(t *testing.T) *fakeIndexStore {
+	return &fakeIndexStore{t: t, saves: make(chan struct{}, 10)}
+}
+
+func (s *fakeIndexStore) SaveIndex(ctx context.Context, index map[string]metadata.RepoMetadata) (cid.Cid, error) {
+	if s.err != nil {
+		return cid.Undef, s.err
+	}
+
+	if s.publishErr != nil {
+		return newTestCID(s.t, strconv.Itoa(len(index))), s.publishErr
+	}
+
+	s.lock.Lock()
+	s.saved = append(s.saved, index)
+	s.lock.Unlock()
+
+	s.saves <- struct{}{}
+
+	return newTestCID(s.t, strconv.Itoa(len(index))), nil
+}
+
+func (s *fakeIndexStore) UnpinIndex(ctx context.Context, indexCID cid.Cid) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.unpinned = append(s.unpinned, indexCID)
+
+	return nil
+}
+
+func (s *fakeIndexStore) onPublished(links ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	links = append([]string{}, links...)
+	sort.Strings(links)
+	s.published = append(s.published, links)
+
+	return nil
+}
+
+func (s *fakeIndexStore) waitSave(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-s.saves:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the index wasn't published")
+	}
+}
+
+func (s *fakeIndexStore) check(t *testing.T, saved []map[string]metadata.RepoMetadata, unpinned []cid.Cid, published [][]string) {
+	t.Helper()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.saved) != len(saved) {
+		t.Fatalf("expected %d saves, got %d", len(saved), len(s.saved))
+	}
+	for i := range saved {
+		if !reflect.DeepEqual(s.saved[i], saved[i]) {
+			t.Errorf("save %d: expected %v, got %v", i, saved[i], s.saved[i])
+		}
+	}
+
+	if len(s.unpinned) != len(unpinned) {
+		t.Fatalf("expected %d unpinned indexes, got %v", len(unpinned), s.unpinned)
+	}
+	for i := range unpinned {
+		if !s.unpinned[i].Equals(unpinned[i]) {
+			t.Errorf("unpin %d: expected %s, got %s", i, unpinned[i], s.unpinned[i])
+		}
+	}
+
+	if !reflect.DeepEqual(s.published, published) {
+		t.Errorf("expected the published repositories %v, got %v", published, s.published)
+	}
+}
+
+func TestIndexWriterFlushEvery(t *testing.T) {
+	store := newFakeIndexStore(t)
+	initial := newTestCID(t, "initial")
+	prev := map[string]metadata.RepoMetadata{"owner/prev": {Description: "prev"}}
+
+	writer := newIndexWriter(store, prev, initial, 0, 2, store.onPublished)
+	go writer.run()
+
+	writer.Update("owner/first", metadata.RepoMetadata{Description: "first"})
+	writer.Update("owner/second", metadata.RepoMetadata{Description: "second"})
+	store.waitSave(t)
+
+	err := writer.close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The previous version is unpinned, nothing is left for the close.
+	store.check(t, []map[string]metadata.RepoMetadata{{
+		"owner/prev":   {Description: "prev"},
+		"owner/first":  {Description: "first"},
+		"owner/second": {Description: "second"},
+	}}, []cid.Cid{initial}, [][]string{{"owner/first", "owner/second"}})
+}
+
+func TestIndexWriterFlushInterval(t *testing.T) {
+	store := newFakeIndexStore(t)
+
+	writer := newIndexWriter(store, map[string]metadata.RepoMetadata{}, cid.Undef, 10*time.Millisecond, 0, store.onPublished)
+	go writer.run()
+
+	writer.Update("owner/first", metadata.RepoMetadata{Description: "first"})
+	store.waitSave(t)
+
+	writer.Update("owner/second", metadata.RepoMetadata{Description: "second"})
+	store.waitSave(t)
+
+	err := writer.close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The first version is unpinned once the second one is published.
+	store.check(t, []map[string]metadata.RepoMetadata{
+		{"owner/first": {Description: "first"}},
+		{"owner/first": {Description: "first"}, "owner/second": {Description: "second"}},
+	}, []cid.Cid{newTestCID(t, "1")}, [][]string{{"owner/first"}, {"owner/second"}})
+}
+
+func TestIndexWriterClose(t *testing.T) {
+	store := newFakeIndexStore(t)
+	initial := newTestCID(t, "initial")
+
+	writer := newIndexWriter(store, map[string]metadata.RepoMetadata{}, initial, 0, 10, store.onPublished)
+	go writer.run()
+
+	writer.Update("owner/first", metadata.RepoMetadata{Description: "first"})
+	writer.Update("owner/first", metadata.RepoMetadata{Description: "updated"})
+
+	err := writer.close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	store.check(t, []map[string]metadata.RepoMetadata{
+		{"owner/first": {Description: "updated"}},
+	}, []cid.Cid{initial}, [][]string{{"owner/first"}})
+}
+
+func TestIndexWriterCloseWithoutUpdate(t *testing.T) {
+	store := newFakeIndexStore(t)
+
+	writer := newIndexWriter(store, map[string]metadata.RepoMetadata{}, newTestCID(t, "initial"), 0, 0, store.onPublished)
+	go writer.run()
+
+	err := writer.close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	store.check(t, nil, nil, nil)
+}
+
+func TestIndexWriterFailedSave(t *testing.T) {
+	store := newFakeIndexStore(t)
+	store.err = errors.New("ipfs unavailable")
+
+	writer := newIndexWriter(store, map[string]metadata.RepoMetadata{}, newTestCID(t, "initial"), 0, 0, store.onPublished)
+	go writer.run()
+
+	writer.Update("owner/first", metadata.RepoMetadata{Description: "first"})
+
+	// The repositories of an unpublished index are not marked.
+	err := writer.close()
+	if !errors.Is(err, store.err) {
+		t.Fatalf("expected the save error, got %v", err)
+	}
+
+	store.check(t, nil, nil, nil)
+}
+
+func TestIndexWriterResolveSubmodules(t *testing.T) {
+	store := newFakeIndexStore(t)
+	libCID := newTestCID(t, "lib")
+	initial := map[string]metadata.RepoMetadata{
+		"owner/lib": {Repo: &libCID},
+		"owner/app": {Submodules: map[string]*cid.Cid{
+			"https://github.com/owner/lib.git": nil,
+			"../tool":                          nil,
+		}},
+	}
+
+	writer := newIndexWriter(store, initial, cid.Undef, 0, 0, store.onPublished)
+
+	// The initial index is resolved.
+	app, _ := writer.Get("owner/app")
+	if c := app.Submodules["https://github.com/owner/lib.git"]; c == nil || !c.Equals(libCID) {
+		t.Errorf("expected the lib submodule to be resolved, got %v", c)
+	}
+
+	// The update of a submodule mirror is given to the entries using it.
+	toolCID := newTestCID(t, "tool")
+	writer.Update("owner/tool", metadata.RepoMetadata{Repo: &toolCID})
+	writer.Update("owner/other", metadata.RepoMetadata{Submodules: map[string]*cid.Cid{
+		"git@github.com:owner/tool": nil,
+	}})
+
+	newLibCID := newTestCID(t, "new lib")
+	writer.Update("owner/lib", metadata.RepoMetadata{Repo: &newLibCID})
+
+	app, _ = writer.Get("owner/app")
+	if c := app.Submodules["https://github.com/owner/lib.git"]; c == nil || !c.Equals(newLibCID) {
+		t.Errorf("expected the new lib mirror, got %v", c)
+	}
+
+	// The relative urls are not resolved without the parent url.
+	if c := app.Submodules["../tool"]; c != nil {
+		t.Errorf("expected the relative url to be left unresolved, got %v", c)
+	}
+
+	other, _ := writer.Get("owner/other")
+	if c := other.Submodules["git@github.com:owner/tool"]; c == nil || !c.Equals(toolCID) {
+		t.Errorf("expected the tool submodule to be resolved, got %v", c)
+	}
+
+	// An entry which doesn't use a submodule anymore isn't updated with it.
+	writer.Update("owner/app", metadata.RepoMetadata{})
+	writer.Update("owner/lib", metadata.RepoMetadata{Repo: &libCID})
+
+	if deps := writer.dependents["owner/lib"]; len(deps) != 0 {
+		t.Errorf("expected no entry using owner/lib, got %v", deps)
+	}
+}
+
+func TestIndexWriterFailedPublish(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  cid.Cid
+		unpinned []cid.Cid
+	}{
+		{
+			name:     "new version",
+			initial:  newTestCID(t, "initial"),
+			unpinned: []cid.Cid{newTestCID(t, "1")},
+		},
+		{
+			// The content didn't change, the published version must stay
+			// pinned.
+			name:    "published version",
+			initial: newTestCID(t, "1"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeIndexStore(t)
+			store.publishErr = errors.New("name publish failed")
+
+			writer := newIndexWriter(store, map[string]metadata.RepoMetadata{}, test.initial, 0, 0, store.onPublished)
+			go writer.run()
+
+			writer.Update("owner/first", metadata.RepoMetadata{Description: "first"})
+
+			err := writer.close()
+			if !errors.Is(err, store.publishErr) {
+				t.Fatalf("expected the publish error, got %v", err)
+			}
+
+			// The pinned version is unpinned, the published one is kept and
+			// the repositories are not marked.
+			store.check(t, nil, test.unpinned, nil)
+
+			if !writer.published.Equals(test.initial) {
+				t.Errorf("expected the published version to stay %s, got %s", test.initial, writer.published)
+			}
+		})
+	}
+}
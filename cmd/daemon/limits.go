@@ -0,0 +1,45 @@
+package main
+
+import "context"
+
+// limiter is a semaphore bounding the number of concurrent calls to run.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	return make(limiter, atLeastOne(n))
+}
+
+func (l limiter) run(ctx context.Context, fn func() error) error {
+	select {
+	case l <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-l }()
+
+	return fn()
+}
+
+// stageLimits are the limiters shared by all the workers, one per kind of
+// resource used by the stages.
+type stageLimits struct {
+	network limiter
+	cpu     limiter
+	ipfs    limiter
+}
+
+func newStageLimits(c Concurrency) *stageLimits {
+	return &stageLimits{
+		network: newLimiter(c.Network),
+		cpu:     newLimiter(c.CPU),
+		ipfs:    newLimiter(c.IPFS),
+	}
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
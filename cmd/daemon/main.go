@@ -1,33 +1,301 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Peltoche/ipfs-gh1000/pkg/git"
 	"github.com/Peltoche/ipfs-gh1000/pkg/ipfs"
 	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/Peltoche/ipfs-gh1000/pkg/scheduler"
+	"github.com/Peltoche/ipfs-gh1000/pkg/state"
+	"github.com/Peltoche/ipfs-gh1000/pkg/workspace"
 	shell "github.com/ipfs/go-ipfs-api"
 )
 
 func main() {
-	metaFetcher, err := metadata.NewFetcher("https://gitstar-ranking.com/repositories")
+	sourceName := flag.String("source", "gitstar", "the repository list source: \"gitstar\", \"static\" or \"github\"")
+	gitstarURL := flag.String("gitstar-url", "https://gitstar-ranking.com/repositories", "the gitstar-ranking page listing the repositories")
+	maxRepos := flag.Int("max-repos", 1000, "the maximum number of repositories fetched from the \"gitstar\" and \"github\" sources")
+	staticFile := flag.String("static-file", "", "the YAML/JSON file listing the repositories for the \"static\" source")
+	githubURL := flag.String("github-api-url", "https://api.github.com/", "the GitHub API url for the \"github\" source")
+	githubQuery := flag.String("github-query", "stars:>1", "the search query used by the \"github\" source")
+	githubEnrich := flag.Bool("github-enrich", os.Getenv("GITHUB_TOKEN") != "", "complete the metadatas of the GitHub repositories with the GitHub API, enabled by default if GITHUB_TOKEN is set (ignored by the \"github\" source)")
+	httpTimeout := flag.Duration("http-timeout", 30*time.Second, "the timeout of the metadata and LFS HTTP requests")
+	httpRetries := flag.Int("http-retries", 5, "the number of retries for the failing metadata and LFS HTTP requests")
+	httpRate := flag.Float64("http-rate", 1, "the maximum number of metadata HTTP requests per second")
+	cacheDir := flag.String("cache-dir", "", "the directory used to cache the metadata pages, disabled if empty")
+	offline := flag.Bool("offline", false, "only use the pages saved inside -cache-dir for the metadatas")
+	workDir := flag.String("work-dir", filepath.Join(os.TempDir(), "gh1000"), "the directory where the repositories are built")
+	memoryLimit := flag.Int64("memory-limit", 64<<20, "the repositories smaller than this size in bytes are built in memory, the others on disk")
+	mirrorRefs := flag.Bool("mirror-refs", false, "store the branches under refs/heads/* instead of refs/remotes/origin/*")
+	fetchTags := flag.Bool("fetch-tags", true, "mirror the tags")
+	fetchPullRequests := flag.Bool("fetch-pull-requests", false, "mirror the GitHub pull requests refs (refs/pull/*)")
+	layoutName := flag.String("layout", string(git.LayoutLoose), "the objects layout: \"loose\", \"packed\" or \"hybrid\"")
+	maxPackSize := flag.Int64("max-pack-size", 0, "split the kept packs bigger than this size in bytes, 0 means no limit")
+	hybridThreshold := flag.Int64("hybrid-threshold", 10<<20, "keep the packs bigger than this size in bytes with the \"hybrid\" layout")
+	gitCredentials := flag.String("git-credentials", "", "the YAML file with the git credentials per host, if empty GITHUB_TOKEN is used for github.com")
+	publishAllow := flag.String("publish-allow", strings.Join(git.DefaultAllowedPaths, ","), "the comma separated patterns of the published paths")
+	publishDeny := flag.String("publish-deny", strings.Join(git.DefaultDeniedPaths, ","), "the comma separated patterns of the paths never published")
+	verify := flag.Bool("verify", true, "check the repositories integrity before publishing them")
+	fetchLFS := flag.Bool("lfs", false, "mirror the Git LFS objects referenced at the tip of every ref")
+	writeBundles := flag.Bool("bundles", false, "publish a full git bundle and an incremental bundle per refresh")
+	bundleMaxIncrementals := flag.Int("bundle-max-incrementals", 30, "rebuild the full bundle once this number of incremental bundles is reached, 0 means no limit")
+	bundleMaxIncrementalRatio := flag.Float64("bundle-max-incremental-ratio", 0.5, "rebuild the full bundle once the incremental bundles reach this fraction of its size, 0 means no limit")
+	workers := flag.Int("workers", 4, "the number of repositories processed in parallel")
+	networkConcurrency := flag.Int("network-concurrency", 4, "the maximum number of repositories fetched from upstream in parallel")
+	cpuConcurrency := flag.Int("cpu-concurrency", runtime.NumCPU(), "the maximum number of repositories unpacked and verified in parallel")
+	ipfsConcurrency := flag.Int("ipfs-concurrency", 2, "the maximum number of repositories downloaded from or uploaded to IPFS in parallel")
+	stateFile := flag.String("state-file", "", "the file saving the progress of each repository, \"<work-dir>/state.json\" if empty")
+	freshness := flag.Duration("freshness", 12*time.Hour, "don't process again the repositories mirrored during this window, 0 disables it")
+	maxAttempts := flag.Int("max-attempts", 3, "the number of failed attempts after which a repository is quarantined")
+	retryBackoff := flag.Duration("retry-backoff", time.Minute, "the delay before retrying a failed repository, doubled after each attempt")
+	quarantine := flag.Duration("quarantine", 7*24*time.Hour, "the duration after which a quarantined repository is processed again, 0 means forever")
+	submoduleDepth := flag.Int("submodule-depth", 0, "the maximum nesting level of the mirrored submodules, 0 disables the submodules mirroring")
+	indexFlushInterval := flag.Duration("index-flush-interval", 10*time.Minute, "publish the index updates at this interval, 0 disables it")
+	indexFlushEvery := flag.Int("index-flush-every", 50, "publish the index once this number of repositories are updated, 0 disables it")
+	continuous := flag.Bool("continuous", false, "keep running and refresh the repositories when they are due")
+	refreshInterval := flag.Duration("refresh-interval", 24*time.Hour, "the delay between two fetches of the repository list in continuous mode")
+	checkInterval := flag.Duration("check-interval", time.Hour, "the delay between two checks of the upstream HEAD of a repository in continuous mode")
+	maxAge := flag.Duration("max-age", 7*24*time.Hour, "publish again the mirrors older than this age in continuous mode even if they didn't change, 0 disables it")
+	statusAddr := flag.String("status-addr", "", "the address serving the scheduler queue on /queue in continuous mode, disabled if empty")
+	flag.Parse()
+
+	layout, err := git.ParseLayout(*layoutName)
+	if err != nil {
+		log.Fatalf("invalid -layout flag: %s", err)
+	}
+
+	var cache *metadata.Cache
+	if *cacheDir != "" {
+		cache, err = metadata.NewCache(*cacheDir, *offline)
+		if err != nil {
+			log.Fatalf("failed to create the metadata cache: %s", err)
+		}
+	} else if *offline {
+		log.Fatalf("the -offline flag requires the -cache-dir flag")
+	}
+
+	client := metadata.NewClient(cache, *httpTimeout, *httpRetries, *httpRate, 1)
+
+	metaSource, err := newRankingSource(client, *sourceName, *gitstarURL, *maxRepos, *staticFile, *githubURL, *githubQuery)
+	if err != nil {
+		log.Fatalf("failed to create the ranking source: %s", err)
+	}
+
+	// The GitHub source already gives the complete metadatas.
+	if *githubEnrich && *sourceName != "github" {
+		github, err := metadata.NewGithubSource(client, *githubURL, *githubQuery, os.Getenv("GITHUB_TOKEN"), *maxRepos)
+		if err != nil {
+			log.Fatalf("failed to create the GitHub source: %s", err)
+		}
+
+		metaSource = metadata.NewEnrichedSource(metaSource, github)
+	}
+
+	workspaces, err := workspace.NewManager(*workDir, *memoryLimit)
+	if err != nil {
+		log.Fatalf("failed to create the workspace manager: %s", err)
+	}
+
+	err = workspaces.Prune()
+	if err != nil {
+		log.Fatalf("failed to remove the old workspaces: %s", err)
+	}
+
+	if *stateFile == "" {
+		*stateFile = filepath.Join(*workDir, "state.json")
+	}
+
+	stateStore, err := state.Open(*stateFile)
 	if err != nil {
-		log.Fatalf("failed to create the fetcher: %s", err)
+		log.Fatalf("failed to open the state store: %s", err)
 	}
 
 	shell := shell.NewLocalShell()
-	unpacker := git.NewUnpacker()
-	gitFetcher := git.NewFetcher()
+	unpacker := git.NewUnpacker(git.UnpackOptions{
+		Layout:          layout,
+		MaxPackSize:     *maxPackSize,
+		HybridThreshold: *hybridThreshold,
+	})
+	credentials, err := newGitCredentials(*gitCredentials)
+	if err != nil {
+		log.Fatalf("failed to load the git credentials: %s", err)
+	}
+
+	gitFetcher := git.NewFetcher(git.FetchOptions{
+		Mirror:       *mirrorRefs,
+		Tags:         *fetchTags,
+		PullRequests: *fetchPullRequests,
+	}, credentials)
 	infoUpdater := git.NewServerInfoUpdater()
 	ipfsUploader := ipfs.NewUploader(shell)
+	ipfsDownloader := ipfs.NewDownloader(shell)
 
 	ipfsIndexer, err := ipfs.NewIndexer(shell, "gh1000")
 	if err != nil {
 		log.Fatalf("failed to initiate the indexer: %s", err)
 	}
 
-	err = Run(metaFetcher, gitFetcher, unpacker, infoUpdater, ipfsUploader, ipfsIndexer)
+	sanitizer := git.NewSanitizer(git.SanitizeOptions{
+		Allow: splitList(*publishAllow),
+		Deny:  splitList(*publishDeny),
+	})
+
+	var verifier *git.Verifier
+	if *verify {
+		verifier = git.NewVerifier()
+	}
+
+	var lfsFetcher *git.LFSFetcher
+	if *fetchLFS {
+		lfsFetcher = git.NewLFSFetcher(credentials, *httpTimeout, metadata.NewRetryPolicy(*httpRetries))
+	}
+
+	var bundler *git.Bundler
+	if *writeBundles {
+		bundler = git.NewBundler(git.BundleOptions{
+			MaxIncrementals:     *bundleMaxIncrementals,
+			MaxIncrementalRatio: *bundleMaxIncrementalRatio,
+		})
+	}
+
+	var submodules *git.SubmoduleScanner
+	if *submoduleDepth > 0 {
+		submodules = git.NewSubmoduleScanner()
+	}
+
+	pipeline := &Pipeline{
+		MetaSource:         metaSource,
+		Workspaces:         workspaces,
+		GitFetcher:         gitFetcher,
+		Unpacker:           unpacker,
+		InfoUpdater:        infoUpdater,
+		Sanitizer:          sanitizer,
+		Verifier:           verifier,
+		IpfsUploader:       ipfsUploader,
+		IpfsDownloader:     ipfsDownloader,
+		Indexer:            ipfsIndexer,
+		IndexFlushInterval: *indexFlushInterval,
+		IndexFlushEvery:    *indexFlushEvery,
+		LFSFetcher:         lfsFetcher,
+		Bundler:            bundler,
+		Submodules:         submodules,
+		SubmoduleDepth:     *submoduleDepth,
+		State:              stateStore,
+		FreshnessWindow:    *freshness,
+		MaxAttempts:        *maxAttempts,
+		RetryBackoff:       *retryBackoff,
+		QuarantineDuration: *quarantine,
+		Concurrency: Concurrency{
+			Workers: *workers,
+			Network: *networkConcurrency,
+			CPU:     *cpuConcurrency,
+			IPFS:    *ipfsConcurrency,
+		},
+	}
+
+	// The first signal stops the pipeline cleanly, the second one kills the
+	// daemon immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		log.Printf("stopping, interrupt again to force it")
+		stop()
+	}()
+
+	if *continuous {
+		sched := scheduler.New(scheduler.SystemClock, scheduler.Options{
+			CheckInterval: *checkInterval,
+			MaxAge:        *maxAge,
+		})
+
+		runCtx, cancelRun := context.WithCancel(ctx)
+		defer cancelRun()
+
+		var statusErr <-chan error
+		if *statusAddr != "" {
+			statusErr, err = serveStatus(runCtx, cancelRun, *statusAddr, sched)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		err = pipeline.RunContinuous(runCtx, sched, scheduler.SystemClock, *refreshInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cancelRun()
+		if statusErr != nil {
+			if err := <-statusErr; err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		return
+	}
+
+	summary, err := pipeline.Run(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	summary.Log()
+	os.Exit(summary.ExitCode())
+}
+
+func newRankingSource(client *metadata.Client, name, gitstarURL string, maxRepos int, staticFile, githubURL, githubQuery string) (metadata.RankingSource, error) {
+	switch name {
+	case "gitstar":
+		return metadata.NewFetcher(client, gitstarURL, maxRepos)
+	case "static":
+		if staticFile == "" {
+			return nil, fmt.Errorf("the \"static\" source requires the -static-file flag")
+		}
+
+		return metadata.NewStaticSource(staticFile), nil
+	case "github":
+		return metadata.NewGithubSource(client, githubURL, githubQuery, os.Getenv("GITHUB_TOKEN"), maxRepos)
+	default:
+		return nil, fmt.Errorf("unknown source %q", name)
+	}
+}
+
+func newGitCredentials(path string) (*git.Credentials, error) {
+	if path != "" {
+		return git.LoadCredentials(path)
+	}
+
+	hosts := map[string]git.HostCredentials{}
+	if os.Getenv("GITHUB_TOKEN") != "" {
+		hosts["github.com"] = git.HostCredentials{
+			Type:        git.CredentialsToken,
+			PasswordEnv: "GITHUB_TOKEN",
+		}
+	}
+
+	return git.NewCredentials(hosts), nil
+}
+
+func splitList(list string) []string {
+	res := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
 }
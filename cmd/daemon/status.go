@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/scheduler"
+)
+
+// statusShutdownTimeout bounds the wait for the status requests in progress
+// when the daemon stops.
+const statusShutdownTimeout = 5 * time.Second
+
+// newStatusHandler exposes the scheduler queue as JSON on "/queue".
+func newStatusHandler(sched *scheduler.Scheduler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(sched.Queue())
+		if err != nil {
+			log.Printf("failed to write the queue: %s", err)
+		}
+	})
+
+	return mux
+}
+
+// serveStatus serves the status handler on addr until ctx is cancelled. The
+// address is listened before returning so an invalid one fails immediately.
+// If the server fails, the run is stopped with cancel. The returned channel
+// receives the error of the server, nil once stopped by ctx.
+func serveStatus(ctx context.Context, cancel context.CancelFunc, addr string, sched *scheduler.Scheduler) (<-chan error, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	srv := &http.Server{Handler: newStatusHandler(sched)}
+	errC := make(chan error, 1)
+
+	go func() {
+		err := srv.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			errC <- nil
+			return
+		}
+
+		errC <- fmt.Errorf("failed to serve the status: %w", err)
+		cancel()
+	}()
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), statusShutdownTimeout)
+		defer cancelShutdown()
+
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	return errC, nil
+}
@@ -12,6 +12,7 @@ require (
 	github.com/ipld/go-ipld-prime v0.16.0
 	github.com/teris-io/cli v1.0.1
 	go.uber.org/multierr v1.8.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -0,0 +1,197 @@
+package git
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// The credential types.
+const (
+	CredentialsToken    = "token"
+	CredentialsBasic    = "basic"
+	CredentialsSSHKey   = "ssh-key"
+	CredentialsSSHAgent = "ssh-agent"
+)
+
+// HostCredentials are the credentials used for a single host. The secrets
+// can be given directly or read from an environment variable.
+type HostCredentials struct {
+	Type             string `yaml:"type"`
+	Username         string `yaml:"username"`
+	Password         string `yaml:"password"`
+	PasswordEnv      string `yaml:"password_env"`
+	KeyFile          string `yaml:"key_file"`
+	KeyPassphraseEnv string `yaml:"key_passphrase_env"`
+}
+
+// Credentials selects the authentication method for each remote host.
+//
+// The credentials are only given to the transport, they are never written
+// into the repository config.
+type Credentials struct {
+	hosts map[string]HostCredentials
+}
+
+func NewCredentials(hosts map[string]HostCredentials) *Credentials {
+	if hosts == nil {
+		hosts = map[string]HostCredentials{}
+	}
+
+	return &Credentials{hosts}
+}
+
+// LoadCredentials reads the credentials from a YAML file with the following
+// format:
+//
+//	github.com:
+//	  type: token
+//	  password_env: GITHUB_TOKEN
+//	git.example.com:
+//	  type: ssh-key
+//	  username: git
+//	  key_file: /home/gh1000/.ssh/id_ed25519
+func LoadCredentials(path string) (*Credentials, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the file %q: %w", path, err)
+	}
+
+	hosts := map[string]HostCredentials{}
+	err = yaml.UnmarshalStrict(raw, &hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the file %q: %w", path, err)
+	}
+
+	return NewCredentials(hosts), nil
+}
+
+// RemoteURL returns the url used to fetch the given repository url. The
+// hosts with SSH credentials are fetched over SSH, with the configured
+// username or "git".
+func (c *Credentials) RemoteURL(repoURL string) (string, error) {
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the url %q: %w", repoURL, err)
+	}
+
+	creds, ok := c.hosts[endpoint.Host]
+	if !ok || !isHTTP(endpoint) || (creds.Type != CredentialsSSHKey && creds.Type != CredentialsSSHAgent) {
+		return repoURL, nil
+	}
+
+	username := creds.Username
+	if username == "" {
+		username = "git"
+	}
+
+	u := url.URL{
+		Scheme: "ssh",
+		User:   url.User(username),
+		Host:   endpoint.Host,
+		Path:   "/" + strings.TrimPrefix(endpoint.Path, "/"),
+	}
+
+	return u.String(), nil
+}
+
+// AuthFor returns the authentication method for the given repository url or
+// nil if no credentials are configured for its host.
+//
+// The SSH credentials are ignored for the HTTP urls, ex: the requests to the
+// LFS API are then anonymous.
+func (c *Credentials) AuthFor(repoURL string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the url %q: %w", repoURL, err)
+	}
+
+	creds, ok := c.hosts[endpoint.Host]
+	if !ok {
+		// The credentials provided inside the url.
+		if endpoint.Password != "" && isHTTP(endpoint) {
+			return &http.BasicAuth{Username: endpoint.User, Password: endpoint.Password}, nil
+		}
+
+		return nil, nil
+	}
+
+	password := creds.Password
+	if creds.PasswordEnv != "" {
+		password = os.Getenv(creds.PasswordEnv)
+	}
+
+	switch creds.Type {
+	case CredentialsToken, CredentialsBasic:
+		if !isHTTP(endpoint) {
+			return nil, fmt.Errorf("%q credentials can't be used with the %q protocol", creds.Type, endpoint.Protocol)
+		}
+
+		username := creds.Username
+		if username == "" {
+			// The username is ignored by the forges when a token is used but
+			// it must not be empty.
+			username = "x-access-token"
+		}
+
+		return &http.BasicAuth{Username: username, Password: password}, nil
+
+	case CredentialsSSHKey, CredentialsSSHAgent:
+		if isHTTP(endpoint) {
+			return nil, nil
+		}
+
+		if endpoint.Protocol != "ssh" {
+			return nil, fmt.Errorf("%q credentials can't be used with the %q protocol", creds.Type, endpoint.Protocol)
+		}
+
+		username := creds.Username
+		if username == "" {
+			username = endpoint.User
+		}
+
+		if creds.Type == CredentialsSSHAgent {
+			return ssh.NewSSHAgentAuth(username)
+		}
+
+		passphrase := ""
+		if creds.KeyPassphraseEnv != "" {
+			passphrase = os.Getenv(creds.KeyPassphraseEnv)
+		}
+
+		return ssh.NewPublicKeysFromFile(username, creds.KeyFile, passphrase)
+
+	default:
+		return nil, fmt.Errorf("unknown credentials type %q for host %q", creds.Type, endpoint.Host)
+	}
+}
+
+// stripURLCredentials removes the secrets from an url in order to save it
+// into the repository config.
+func stripURLCredentials(repoURL string) (string, error) {
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the url %q: %w", repoURL, err)
+	}
+
+	if endpoint.Password == "" && (endpoint.User == "" || !isHTTP(endpoint)) {
+		return repoURL, nil
+	}
+
+	endpoint.Password = ""
+	if isHTTP(endpoint) {
+		endpoint.User = ""
+	}
+
+	return endpoint.String(), nil
+}
+
+func isHTTP(endpoint *transport.Endpoint) bool {
+	return endpoint.Protocol == "http" || endpoint.Protocol == "https"
+}
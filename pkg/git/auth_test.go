@@ -0,0 +1,40 @@
+package git
+
+import "testing"
+
+func TestCredentialsRemoteURL(t *testing.T) {
+	creds := NewCredentials(map[string]HostCredentials{
+		"github.com":      {Type: CredentialsToken, Password: "secret"},
+		"git.example.com": {Type: CredentialsSSHKey, KeyFile: "id_ed25519"},
+		"git.corp.com":    {Type: CredentialsSSHAgent, Username: "mirror"},
+	})
+
+	tests := []struct {
+		repoURL  string
+		expected string
+	}{
+		{repoURL: "https://github.com/torvalds/linux", expected: "https://github.com/torvalds/linux"},
+		{repoURL: "https://gitlab.com/team/repo", expected: "https://gitlab.com/team/repo"},
+		{repoURL: "https://git.example.com/team/repo", expected: "ssh://git@git.example.com/team/repo"},
+		{repoURL: "https://git.corp.com/team/repo.git", expected: "ssh://mirror@git.corp.com/team/repo.git"},
+		{repoURL: "ssh://git@git.example.com/team/repo", expected: "ssh://git@git.example.com/team/repo"},
+	}
+
+	for _, test := range tests {
+		remoteURL, err := creds.RemoteURL(test.repoURL)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.repoURL, err)
+			continue
+		}
+
+		if remoteURL != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.repoURL, test.expected, remoteURL)
+		}
+	}
+
+	// The LFS requests are sent over https without the SSH credentials.
+	auth, err := creds.AuthFor("https://git.example.com/team/repo")
+	if err != nil || auth != nil {
+		t.Errorf("expected no authentication for the SSH host over https, got %v, %v", auth, err)
+	}
+}
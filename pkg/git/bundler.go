@@ -0,0 +1,380 @@
+package git
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const (
+	// BundlesDir is the directory containing the bundles.
+	BundlesDir = "bundles"
+	// FullBundle is the name of the bundle the incremental bundles apply
+	// on.
+	FullBundle = "full.bundle"
+
+	bundleSignature = "# v2 git bundle"
+	// bundleNameFormat is used to name the incremental bundles with their
+	// sequence number and their date. The sequence number makes the names
+	// unique and their lexical order the order they apply in.
+	bundleNameFormat = "%06d-%s.bundle"
+	bundleTimeFormat = "20060102T150405Z"
+)
+
+// BundleOptions selects when the full bundle is rebuilt.
+type BundleOptions struct {
+	// MaxIncrementals is the number of incremental bundles from which the
+	// full bundle is rebuilt. 0 means no limit.
+	MaxIncrementals int
+	// MaxIncrementalRatio is the total size of the incremental bundles,
+	// relative to the size of the full bundle, from which the full bundle is
+	// rebuilt. 0 means no limit.
+	MaxIncrementalRatio float64
+}
+
+// Bundler writes git bundles, allowing to clone or fetch a repository from a
+// single file.
+type Bundler struct {
+	opts BundleOptions
+}
+
+func NewBundler(opts BundleOptions) *Bundler {
+	return &Bundler{opts}
+}
+
+// WriteBundles writes inside BundlesDir a full bundle containing all the
+// refs, then an incremental bundle "<sequence>-<date>.bundle" per refresh
+// with the objects added since the previous bundle. Each incremental bundle applies on
+// top of the previous one, the first one on the full bundle.
+//
+// Encoding the full bundle is expensive so it's only rebuilt once the
+// incremental bundles exceed the limits of the BundleOptions, the
+// incremental bundles superseded by it are then removed.
+//
+// A cancelled context stops it before the rebuild of the full bundle.
+func (b *Bundler) WriteBundles(ctx context.Context, storage *filesystem.Storage, date time.Time) error {
+	fs := storage.Filesystem()
+
+	refs, err := bundleRefs(storage)
+	if err != nil {
+		return err
+	}
+
+	fullPath := path.Join(BundlesDir, FullBundle)
+
+	fullStat, err := fs.Stat(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return b.writeFullBundle(storage, refs, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat the full bundle: %w", err)
+	}
+
+	incrementals, incrementalsSize, err := listIncrementalBundles(storage)
+	if err != nil {
+		return err
+	}
+
+	lastPath := fullPath
+	if len(incrementals) > 0 {
+		lastPath = incrementals[len(incrementals)-1]
+	}
+
+	prevRefs, err := readBundleRefs(storage, lastPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the previous bundle: %w", err)
+	}
+
+	if sameRefs(refs, prevRefs) {
+		return nil
+	}
+
+	if b.needsRebuild(len(incrementals), incrementalsSize, fullStat.Size()) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return b.writeFullBundle(storage, refs, incrementals)
+	}
+
+	prereqs, err := bundlePrerequisites(storage, prevRefs)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf(bundleNameFormat, len(incrementals)+1, date.UTC().Format(bundleTimeFormat))
+	err = b.writeBundle(storage, path.Join(BundlesDir, name), refs, prereqs)
+	if err != nil {
+		return fmt.Errorf("failed to write the incremental bundle: %w", err)
+	}
+
+	return nil
+}
+
+// needsRebuild returns true if the incremental bundles exceed the limits.
+func (b *Bundler) needsRebuild(nbIncrementals int, incrementalsSize int64, fullSize int64) bool {
+	if b.opts.MaxIncrementals > 0 && nbIncrementals >= b.opts.MaxIncrementals {
+		return true
+	}
+
+	return b.opts.MaxIncrementalRatio > 0 && float64(incrementalsSize) >= b.opts.MaxIncrementalRatio*float64(fullSize)
+}
+
+// writeFullBundle writes the full bundle then removes the incremental
+// bundles superseded by it.
+func (b *Bundler) writeFullBundle(storage *filesystem.Storage, refs []*plumbing.Reference, superseded []string) error {
+	err := b.writeBundle(storage, path.Join(BundlesDir, FullBundle), refs, nil)
+	if err != nil {
+		return fmt.Errorf("failed to write the full bundle: %w", err)
+	}
+
+	for _, filePath := range superseded {
+		err = storage.Filesystem().Remove(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to remove the superseded bundle %q: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+// listIncrementalBundles returns the paths of the incremental bundles in
+// the order they apply in and their total size.
+func listIncrementalBundles(storage *filesystem.Storage) ([]string, int64, error) {
+	entries, err := storage.Filesystem().ReadDir(BundlesDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list the bundles: %w", err)
+	}
+
+	var (
+		res  []string
+		size int64
+	)
+
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == FullBundle || !strings.HasSuffix(entry.Name(), ".bundle") {
+			continue
+		}
+
+		res = append(res, path.Join(BundlesDir, entry.Name()))
+		size += entry.Size()
+	}
+
+	sort.Strings(res)
+
+	return res, size, nil
+}
+
+// writeBundle writes a v2 bundle with the given refs, the objects reachable
+// from the prerequisites are excluded.
+func (b *Bundler) writeBundle(storage *filesystem.Storage, filePath string, refs []*plumbing.Reference, prereqs []plumbing.Hash) error {
+	fs := storage.Filesystem()
+
+	wants := []plumbing.Hash{}
+	for _, ref := range refs {
+		wants = append(wants, ref.Hash())
+	}
+
+	hashes, err := revlist.Objects(storage, wants, prereqs)
+	if err != nil {
+		return fmt.Errorf("failed to list the objects: %w", err)
+	}
+
+	err = fs.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create the %s directory: %w", path.Dir(filePath), err)
+	}
+
+	tmp, err := util.TempFile(fs, path.Dir(filePath), "tmp_bundle_")
+	if err != nil {
+		return fmt.Errorf("failed to create the temporary file: %w", err)
+	}
+
+	err = writeBundleContent(tmp, storage, refs, prereqs, hashes)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tmp.Name())
+		return err
+	}
+
+	err = fs.Rename(tmp.Name(), filePath)
+	if err != nil {
+		_ = fs.Remove(tmp.Name())
+		return fmt.Errorf("failed to move the bundle: %w", err)
+	}
+
+	return nil
+}
+
+func writeBundleContent(w io.Writer, storage *filesystem.Storage, refs []*plumbing.Reference, prereqs []plumbing.Hash, hashes []plumbing.Hash) error {
+	header := strings.Builder{}
+
+	header.WriteString(bundleSignature + "\n")
+	for _, hash := range prereqs {
+		header.WriteString(fmt.Sprintf("-%s\n", hash))
+	}
+	for _, ref := range refs {
+		header.WriteString(fmt.Sprintf("%s %s\n", ref.Hash(), ref.Name()))
+	}
+	header.WriteString("\n")
+
+	_, err := io.WriteString(w, header.String())
+	if err != nil {
+		return fmt.Errorf("failed to write the header: %w", err)
+	}
+
+	_, err = packfile.NewEncoder(w, storage, false).Encode(hashes, 10)
+	if err != nil {
+		return fmt.Errorf("failed to encode the pack: %w", err)
+	}
+
+	return nil
+}
+
+// bundleRefs returns the sorted hash references, preceded by the resolved
+// HEAD in order to checkout the default branch when cloning the bundle.
+func bundleRefs(storage *filesystem.Storage) ([]*plumbing.Reference, error) {
+	iter, err := storage.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an iterator on references: %w", err)
+	}
+
+	refs := []*plumbing.Reference{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs = append(refs, ref)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the references: %w", err)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name() < refs[j].Name()
+	})
+
+	head, err := storer.ResolveReference(storage, plumbing.HEAD)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+	if err == nil {
+		refs = append([]*plumbing.Reference{plumbing.NewHashReference(plumbing.HEAD, head.Hash())}, refs...)
+	}
+
+	return refs, nil
+}
+
+// readBundleRefs returns the references listed by the header of a bundle.
+func readBundleRefs(storage *filesystem.Storage, filePath string) ([]*plumbing.Reference, error) {
+	f, err := storage.Filesystem().Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+
+	signature, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the signature: %w", err)
+	}
+	if strings.TrimSuffix(signature, "\n") != bundleSignature {
+		return nil, fmt.Errorf("unsupported bundle signature %q", signature)
+	}
+
+	refs := []*plumbing.Reference{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the header: %w", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid header line %q", line)
+		}
+
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(name), plumbing.NewHash(hash)))
+	}
+
+	return refs, nil
+}
+
+// bundlePrerequisites returns the commits pointed by the given references.
+// The references to missing objects or to non-commit objects are ignored.
+func bundlePrerequisites(storage *filesystem.Storage, refs []*plumbing.Reference) ([]plumbing.Hash, error) {
+	seen := map[plumbing.Hash]struct{}{}
+	res := []plumbing.Hash{}
+
+	for _, ref := range refs {
+		target, err := peelTag(storage, ref.Hash())
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", ref.Name(), err)
+		}
+
+		_, err = object.GetCommit(storage, target)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve the commit of %s: %w", ref.Name(), err)
+		}
+
+		if _, ok := seen[target]; !ok {
+			seen[target] = struct{}{}
+			res = append(res, target)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].String() < res[j].String()
+	})
+
+	return res, nil
+}
+
+func sameRefs(a, b []*plumbing.Reference) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name() != b[i].Name() || a[i].Hash() != b[i].Hash() {
+			return false
+		}
+	}
+
+	return true
+}
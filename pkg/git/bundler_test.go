@@ -0,0 +1,179 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// commitFile adds a commit on top of parent, if defined, with a single file,
+// and moves master to it.
+func commitFile(t *testing.T, storage *filesystem.Storage, parent plumbing.Hash, content string) plumbing.Hash {
+	t.Helper()
+
+	encode := func(obj interface {
+		Encode(plumbing.EncodedObject) error
+	}) plumbing.Hash {
+		encoded := storage.NewEncodedObject()
+		err := obj.Encode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := storage.SetEncodedObject(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	blob := storage.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, err := blob.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(content))
+	_ = w.Close()
+
+	blobHash, err := storage.SetEncodedObject(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	treeHash := encode(&object.Tree{Entries: []object.TreeEntry{
+		{Name: "file.txt", Mode: filemode.Regular, Hash: blobHash},
+	}})
+
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1649116800, 0)}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: content, TreeHash: treeHash}
+	if !parent.IsZero() {
+		commit.ParentHashes = []plumbing.Hash{parent}
+	}
+
+	hash := encode(commit)
+
+	err = storage.SetReference(plumbing.NewHashReference(plumbing.Master, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+func listBundles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(dir, BundlesDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := []string{}
+	for _, entry := range entries {
+		res = append(res, entry.Name())
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+func TestBundlerWriteBundles(t *testing.T) {
+	dir := t.TempDir()
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	bundler := NewBundler(BundleOptions{MaxIncrementals: 2})
+
+	date := time.Date(2022, 4, 5, 11, 40, 0, 0, time.UTC)
+	write := func() {
+		t.Helper()
+
+		// The refreshes are in the same second, the bundle names must be
+		// unique anyway.
+		err := bundler.WriteBundles(context.Background(), storage, date)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	fullPath := filepath.Join(dir, BundlesDir, FullBundle)
+
+	first := commitFile(t, storage, plumbing.ZeroHash, "first")
+	err := storage.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write()
+
+	fullStat, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unchanged refs don't give any new bundle.
+	write()
+
+	if bundles := listBundles(t, dir); !reflect.DeepEqual(bundles, []string{FullBundle}) {
+		t.Fatalf("expected only the full bundle, got %v", bundles)
+	}
+
+	second := commitFile(t, storage, first, "second")
+	write()
+	third := commitFile(t, storage, second, "third")
+	write()
+
+	expected := []string{"000001-20220405T114000Z.bundle", "000002-20220405T114000Z.bundle", FullBundle}
+	if bundles := listBundles(t, dir); !reflect.DeepEqual(bundles, expected) {
+		t.Fatalf("expected %v, got %v", expected, bundles)
+	}
+
+	// The full bundle is kept as is.
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stat.ModTime().Equal(fullStat.ModTime()) || stat.Size() != fullStat.Size() {
+		t.Errorf("expected the full bundle to be kept")
+	}
+
+	// Each incremental bundle applies on top of the previous one.
+	content, err := os.ReadFile(filepath.Join(dir, BundlesDir, expected[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := bundleSignature + "\n-" + second.String() + "\n" +
+		third.String() + " HEAD\n" + third.String() + " refs/heads/master\n\n"
+	if len(content) < len(header) || string(content[:len(header)]) != header {
+		t.Errorf("invalid incremental bundle header: %q", content)
+	}
+
+	// The limit is reached, the full bundle is rebuilt.
+	fourth := commitFile(t, storage, third, "fourth")
+	write()
+
+	if bundles := listBundles(t, dir); !reflect.DeepEqual(bundles, []string{FullBundle}) {
+		t.Fatalf("expected the incremental bundles to be removed, got %v", bundles)
+	}
+
+	refs, err := readBundleRefs(storage, filepath.Join(BundlesDir, FullBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) != 2 || refs[1].Hash() != fourth {
+		t.Errorf("expected the full bundle to contain the last commit, got %v", refs)
+	}
+}
@@ -5,49 +5,432 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
+// ErrEmptyRepository is returned when the upstream repository doesn't
+// contain any commit.
+var ErrEmptyRepository = errors.New("the upstream repository is empty")
+
+// FetchResult describes the upstream state of a fetched repository.
+type FetchResult struct {
+	// DefaultBranch is the branch pointed by the upstream HEAD.
+	DefaultBranch plumbing.ReferenceName
+	// Head is the commit pointed by the upstream HEAD.
+	Head plumbing.Hash
+	// Changed is true if the fetch modified any reference or the default
+	// branch.
+	Changed bool
+	// Refs is the list of the mirrored references.
+	Refs []plumbing.ReferenceName
+	// PublishedRefs is the upstream references selected by the options,
+	// under their published names.
+	PublishedRefs map[plumbing.ReferenceName]plumbing.Hash
+}
+
+// FetchOptions selects the upstream references to mirror.
+type FetchOptions struct {
+	// Mirror stores the branches under "refs/heads/*" instead of
+	// "refs/remotes/origin/*".
+	Mirror bool
+	// Tags fetches all the "refs/tags/*".
+	Tags bool
+	// PullRequests fetches the GitHub pull requests refs "refs/pull/*".
+	PullRequests bool
+}
+
+// RefSpecs returns the refspecs matching the options.
+func (o FetchOptions) RefSpecs() []config.RefSpec {
+	refSpecs := []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+	if o.Mirror {
+		refSpecs[0] = "+refs/heads/*:refs/heads/*"
+	}
+
+	if o.Tags {
+		refSpecs = append(refSpecs, "+refs/tags/*:refs/tags/*")
+	}
+
+	if o.PullRequests {
+		refSpecs = append(refSpecs, "+refs/pull/*:refs/pull/*")
+	}
+
+	return refSpecs
+}
+
 type Fetcher struct {
-	storage *filesystem.Storage
+	opts  FetchOptions
+	creds *Credentials
 }
 
-func NewFetcher() *Fetcher {
-	return &Fetcher{}
+func NewFetcher(opts FetchOptions, creds *Credentials) *Fetcher {
+	return &Fetcher{opts, creds}
 }
 
-func (f *Fetcher) CloneRepositoryInto(ctx context.Context, repoURL string, storage *filesystem.Storage) error {
-	repo, err := git.Init(storage, nil)
+// FetchUpstreamHead retrieves the upstream HEAD and references without
+// fetching anything.
+func (f *Fetcher) FetchUpstreamHead(ctx context.Context, repoURL string) (*FetchResult, error) {
+	remoteURL, auth, err := f.remoteEndpoint(repoURL)
 	if err != nil {
-		return fmt.Errorf("failed to init the new repository: %w", err)
+		return nil, err
 	}
 
-	_, err = repo.CreateRemote(&config.RemoteConfig{
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{remoteURL},
+	})
+
+	res, _, err := f.listUpstreamHead(ctx, remote, auth)
+
+	return res, err
+}
+
+// FetchRepositoryInto fetches the repository into the given storage.
+//
+// If the storage already contains a repository (a previously mirrored
+// version for example), only the missing objects are fetched and the
+// references deleted upstream are removed.
+func (f *Fetcher) FetchRepositoryInto(ctx context.Context, repoURL string, storage *filesystem.Storage) (*FetchResult, error) {
+	repo, err := git.Open(storage, nil)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.Init(storage, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the repository: %w", err)
+	}
+
+	// The previous version can have a different url or no remote at all.
+	err = repo.DeleteRemote("origin")
+	if err != nil && !errors.Is(err, git.ErrRemoteNotFound) {
+		return nil, fmt.Errorf("failed to remove the previous remote: %w", err)
+	}
+
+	refSpecs := f.opts.RefSpecs()
+
+	remoteURL, auth, err := f.remoteEndpoint(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
 		Name:  "origin",
-		URLs:  []string{repoURL},
-		Fetch: []config.RefSpec{},
+		URLs:  []string{remoteURL},
+		Fetch: refSpecs,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to create the new remote: %w", err)
+		return nil, fmt.Errorf("failed to create the new remote: %w", err)
+	}
+
+	res, upstreamRefs, err := f.listUpstreamHead(ctx, remote, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	refsBefore, err := snapshotRefs(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	headBefore, err := storage.Reference(plumbing.HEAD)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, fmt.Errorf("failed to read the HEAD: %w", err)
+	}
+
+	// The pruning is done before the fetch in order to keep the references
+	// created upstream after the listing.
+	err = pruneRefs(storage, refSpecs, upstreamRefs)
+	if err != nil {
+		return nil, err
 	}
 
 	err = repo.FetchContext(ctx, &git.FetchOptions{
 		RemoteName:      "origin",
-		RefSpecs:        []config.RefSpec{},
+		RefSpecs:        refSpecs,
 		Depth:           0,
-		Auth:            nil,
+		Auth:            auth,
 		Progress:        io.Discard,
-		Tags:            0,
+		Tags:            git.NoTags, // The tags are fetched with an explicit refspec.
 		Force:           false,
 		InsecureSkipTLS: false,
 		CABundle:        []byte{},
 	})
 	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
-		return fmt.Errorf("failed to pull the latest changes: %w", err)
+		return nil, fmt.Errorf("failed to pull the latest changes: %w", wrapContextError(ctx, err))
+	}
+
+	// Mirror the upstream HEAD in order to checkout the default branch
+	// when cloning the published repository.
+	if res.DefaultBranch != "" {
+		err = storage.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, res.DefaultBranch))
+		if err != nil {
+			return nil, fmt.Errorf("failed to set the HEAD: %w", err)
+		}
+	}
+
+	refsAfter, err := snapshotRefs(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Changed = !reflect.DeepEqual(publishedRefs(refsBefore), publishedRefs(refsAfter))
+
+	// The upstream can switch its default branch without any ref update.
+	if res.DefaultBranch != "" && (headBefore == nil || headBefore.Target() != res.DefaultBranch) {
+		res.Changed = true
+	}
+
+	for name := range refsAfter {
+		for _, refSpec := range refSpecs {
+			if refSpec.Reverse().Match(name) {
+				res.Refs = append(res.Refs, name)
+				break
+			}
+		}
+	}
+
+	sort.Slice(res.Refs, func(i, j int) bool {
+		return res.Refs[i] < res.Refs[j]
+	})
+
+	return res, nil
+}
+
+// remoteEndpoint returns the url without any secret and the authentication
+// method for the given repository.
+func (f *Fetcher) remoteEndpoint(repoURL string) (string, transport.AuthMethod, error) {
+	var auth transport.AuthMethod
+
+	if f.creds != nil {
+		var err error
+		repoURL, err = f.creds.RemoteURL(repoURL)
+		if err != nil {
+			return "", nil, err
+		}
+
+		auth, err = f.creds.AuthFor(repoURL)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to retrieve the credentials: %w", err)
+		}
+	}
+
+	remoteURL, err := stripURLCredentials(repoURL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return remoteURL, auth, nil
+}
+
+// listUpstreamHead returns the upstream HEAD and the references advertised by
+// the remote. It returns ErrEmptyRepository if there is nothing to fetch.
+func (f *Fetcher) listUpstreamHead(ctx context.Context, remote *git.Remote, auth transport.AuthMethod) (*FetchResult, []*plumbing.Reference, error) {
+	upstreamRefs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil, nil, ErrEmptyRepository
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list the upstream references: %w", wrapContextError(ctx, err))
+	}
+
+	res, err := resolveUpstreamHead(upstreamRefs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res.PublishedRefs = map[plumbing.ReferenceName]plumbing.Hash{}
+	for _, ref := range upstreamRefs {
+		if ref.Type() != plumbing.HashReference || ref.Name() == plumbing.HEAD {
+			continue
+		}
+
+		for _, refSpec := range f.opts.RefSpecs() {
+			if refSpec.Match(ref.Name()) {
+				res.PublishedRefs[publishedRefName(refSpec.Dst(ref.Name()))] = ref.Hash()
+				break
+			}
+		}
+	}
+
+	return res, upstreamRefs, nil
+}
+
+// pruneRefs removes the mirrored references which are not advertised
+// upstream anymore. The references of a previous version have their
+// published names, "refs/heads/*" instead of "refs/remotes/origin/*", so
+// both names are checked against the refspecs.
+func pruneRefs(storage *filesystem.Storage, refSpecs []config.RefSpec, upstreamRefs []*plumbing.Reference) error {
+	upstream := make(map[plumbing.ReferenceName]bool, len(upstreamRefs))
+	for _, ref := range upstreamRefs {
+		upstream[ref.Name()] = true
+	}
+
+	localRefs, err := snapshotRefs(storage)
+	if err != nil {
+		return err
+	}
+
+	for name := range localRefs {
+		names := []plumbing.ReferenceName{name}
+		if name.IsBranch() {
+			names = append(names, plumbing.ReferenceName(remoteRefPrefix+name.Short()))
+		}
+
+		mirrored, deleted := false, true
+		for _, localName := range names {
+			for _, refSpec := range refSpecs {
+				// The force flag would be kept on the reversed destination.
+				reverse := config.RefSpec(strings.TrimPrefix(refSpec.String(), "+")).Reverse()
+				if !reverse.Match(localName) {
+					continue
+				}
+
+				mirrored = true
+				if upstream[reverse.Dst(localName)] {
+					deleted = false
+				}
+			}
+		}
+
+		if !mirrored || !deleted {
+			continue
+		}
+
+		err = storage.RemoveReference(name)
+		if err != nil {
+			return fmt.Errorf("failed to remove the ref %q deleted upstream: %w", name, err)
+		}
 	}
 
 	return nil
 }
+
+// snapshotRefs returns the hash of every reference inside the storage.
+func snapshotRefs(storage *filesystem.Storage) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	res := map[plumbing.ReferenceName]plumbing.Hash{}
+
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an iterator on references: %w", err)
+	}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			res[ref.Name()] = ref.Hash()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the references: %w", err)
+	}
+
+	return res, nil
+}
+
+// publishedRefs returns the references as seen once published: the
+// "refs/remotes/origin/*" references replace the "refs/heads/*" ones.
+func publishedRefs(refs map[plumbing.ReferenceName]plumbing.Hash) map[plumbing.ReferenceName]plumbing.Hash {
+	res := make(map[plumbing.ReferenceName]plumbing.Hash, len(refs))
+
+	for name, hash := range refs {
+		if !strings.HasPrefix(name.String(), remoteRefPrefix) {
+			res[name] = hash
+		}
+	}
+
+	for name, hash := range refs {
+		if strings.HasPrefix(name.String(), remoteRefPrefix) {
+			res[plumbing.NewBranchReferenceName(strings.TrimPrefix(name.String(), remoteRefPrefix))] = hash
+		}
+	}
+
+	return res
+}
+
+// publishedRefName returns the name of a reference once published.
+func publishedRefName(name plumbing.ReferenceName) plumbing.ReferenceName {
+	if strings.HasPrefix(name.String(), remoteRefPrefix) {
+		return plumbing.NewBranchReferenceName(strings.TrimPrefix(name.String(), remoteRefPrefix))
+	}
+
+	return name
+}
+
+// resolveUpstreamHead finds the default branch and the HEAD commit from the
+// references advertised by the remote.
+func resolveUpstreamHead(refs []*plumbing.Reference) (*FetchResult, error) {
+	var head *plumbing.Reference
+	hashes := map[plumbing.ReferenceName]plumbing.Hash{}
+
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+			continue
+		}
+
+		if ref.Type() == plumbing.HashReference {
+			hashes[ref.Name()] = ref.Hash()
+		}
+	}
+
+	if head == nil && len(hashes) == 0 {
+		return nil, ErrEmptyRepository
+	}
+
+	if head == nil {
+		return nil, errors.New("the remote doesn't advertise any HEAD")
+	}
+
+	// The remote advertise the branch with the "symref" capability.
+	if head.Type() == plumbing.SymbolicReference {
+		hash, ok := hashes[head.Target()]
+		if !ok {
+			return nil, fmt.Errorf("the upstream HEAD points to the unknown ref %q", head.Target())
+		}
+
+		return &FetchResult{DefaultBranch: head.Target(), Head: hash}, nil
+	}
+
+	// Otherwise guess the branch from the hash, the usual names first.
+	res := &FetchResult{Head: head.Hash()}
+	for _, name := range []plumbing.ReferenceName{plumbing.NewBranchReferenceName("main"), plumbing.Master} {
+		if hashes[name] == head.Hash() {
+			res.DefaultBranch = name
+			return res, nil
+		}
+	}
+
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name.String())
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		refName := plumbing.ReferenceName(name)
+		if refName.IsBranch() && hashes[refName] == head.Hash() {
+			res.DefaultBranch = refName
+			return res, nil
+		}
+	}
+
+	return res, nil
+}
+
+// wrapContextError returns the error of an operation interrupted by ctx
+// wrapping the context error. The go-git transports don't always keep it.
+func wrapContextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %s", ctxErr, err)
+	}
+
+	return err
+}
@@ -0,0 +1,266 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// newUpstream creates a local bare repository served with the file
+// transport.
+func newUpstream(t *testing.T) (*filesystem.Storage, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	_, err := git.PlainInit(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault()), "file://" + dir
+}
+
+func newLocalStorage(t *testing.T) *filesystem.Storage {
+	t.Helper()
+
+	return filesystem.NewStorage(osfs.New(t.TempDir()), cache.NewObjectLRUDefault())
+}
+
+func TestFetcherFetchRepositoryInto(t *testing.T) {
+	upstream, upstreamURL := newUpstream(t)
+	first := commitFile(t, upstream, plumbing.ZeroHash, "first")
+
+	second := commitFile(t, upstream, first, "second")
+	err := upstream.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("dev"), second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = upstream.SetReference(plumbing.NewHashReference(plumbing.Master, first))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := NewFetcher(FetchOptions{Mirror: true}, nil)
+	storage := newLocalStorage(t)
+
+	fetch := func() *FetchResult {
+		t.Helper()
+
+		res, err := fetcher.FetchRepositoryInto(context.Background(), upstreamURL, storage)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		return res
+	}
+
+	res := fetch()
+	if !res.Changed || res.DefaultBranch != plumbing.Master || res.Head != first {
+		t.Errorf("unexpected first fetch result: %+v", res)
+	}
+
+	if len(res.Refs) != 2 || res.Refs[0] != "refs/heads/dev" || res.Refs[1] != plumbing.Master {
+		t.Errorf("expected dev and master to be mirrored, got %v", res.Refs)
+	}
+
+	if res := fetch(); res.Changed {
+		t.Errorf("expected nothing to change, got %+v", res)
+	}
+
+	// The upstream switches its default branch without any ref update.
+	err = upstream.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = fetch()
+	if !res.Changed || res.DefaultBranch != "refs/heads/dev" || res.Head != second {
+		t.Errorf("expected the new default branch to be detected, got %+v", res)
+	}
+
+	head, err := storage.Reference(plumbing.HEAD)
+	if err != nil || head.Target() != "refs/heads/dev" {
+		t.Errorf("expected the HEAD to point to dev, got %v, %v", head, err)
+	}
+
+	if res := fetch(); res.Changed {
+		t.Errorf("expected nothing to change, got %+v", res)
+	}
+}
+
+func TestFetcherEmptyUpstream(t *testing.T) {
+	_, upstreamURL := newUpstream(t)
+	fetcher := NewFetcher(FetchOptions{}, nil)
+
+	_, err := fetcher.FetchUpstreamHead(context.Background(), upstreamURL)
+	if !errors.Is(err, ErrEmptyRepository) {
+		t.Errorf("expected ErrEmptyRepository, got %v", err)
+	}
+
+	_, err = fetcher.FetchRepositoryInto(context.Background(), upstreamURL, newLocalStorage(t))
+	if !errors.Is(err, ErrEmptyRepository) {
+		t.Errorf("expected ErrEmptyRepository, got %v", err)
+	}
+}
+
+func TestFetchOptionsRefSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     FetchOptions
+		expected []config.RefSpec
+	}{
+		{
+			name:     "default",
+			opts:     FetchOptions{},
+			expected: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+		},
+		{
+			name:     "mirror",
+			opts:     FetchOptions{Mirror: true},
+			expected: []config.RefSpec{"+refs/heads/*:refs/heads/*"},
+		},
+		{
+			name: "all",
+			opts: FetchOptions{Mirror: true, Tags: true, PullRequests: true},
+			expected: []config.RefSpec{
+				"+refs/heads/*:refs/heads/*",
+				"+refs/tags/*:refs/tags/*",
+				"+refs/pull/*:refs/pull/*",
+			},
+		},
+		{
+			name: "remotes with tags",
+			opts: FetchOptions{Tags: true},
+			expected: []config.RefSpec{
+				"+refs/heads/*:refs/remotes/origin/*",
+				"+refs/tags/*:refs/tags/*",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := test.opts.RefSpecs()
+			if !reflect.DeepEqual(res, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, res)
+			}
+
+			for _, refSpec := range res {
+				if err := refSpec.Validate(); err != nil {
+					t.Errorf("invalid refspec %q: %s", refSpec, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneRefs(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     FetchOptions
+		local    []plumbing.ReferenceName
+		upstream []plumbing.ReferenceName
+		expected []plumbing.ReferenceName
+	}{
+		{
+			name: "remotes",
+			opts: FetchOptions{},
+			local: []plumbing.ReferenceName{
+				"refs/remotes/origin/master",
+				"refs/remotes/origin/gone",
+				"refs/tags/v1",
+			},
+			upstream: []plumbing.ReferenceName{"refs/heads/master"},
+			// The tags are not mirrored, so they are left untouched.
+			expected: []plumbing.ReferenceName{"refs/remotes/origin/master", "refs/tags/v1"},
+		},
+		{
+			name: "published names of a previous version",
+			opts: FetchOptions{},
+			local: []plumbing.ReferenceName{
+				"refs/heads/master",
+				"refs/heads/gone",
+			},
+			upstream: []plumbing.ReferenceName{"refs/heads/master"},
+			expected: []plumbing.ReferenceName{"refs/heads/master"},
+		},
+		{
+			name: "mirror with tags and pull requests",
+			opts: FetchOptions{Mirror: true, Tags: true, PullRequests: true},
+			local: []plumbing.ReferenceName{
+				"refs/heads/master",
+				"refs/heads/gone",
+				"refs/tags/v1",
+				"refs/tags/v0",
+				"refs/pull/1/head",
+				"refs/pull/2/head",
+			},
+			upstream: []plumbing.ReferenceName{
+				"refs/heads/master",
+				"refs/tags/v1",
+				"refs/pull/2/head",
+			},
+			expected: []plumbing.ReferenceName{
+				"refs/heads/master",
+				"refs/pull/2/head",
+				"refs/tags/v1",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newLocalStorage(t)
+			commit := commitFile(t, storage, plumbing.ZeroHash, "content")
+
+			// commitFile creates master, only the listed references are
+			// expected.
+			err := storage.RemoveReference(plumbing.Master)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range test.local {
+				err := storage.SetReference(plumbing.NewHashReference(name, commit))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			upstreamRefs := []*plumbing.Reference{plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master)}
+			for _, name := range test.upstream {
+				upstreamRefs = append(upstreamRefs, plumbing.NewHashReference(name, commit))
+			}
+
+			err = pruneRefs(storage, test.opts.RefSpecs(), upstreamRefs)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			refs, err := snapshotRefs(storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := []plumbing.ReferenceName{}
+			for name := range refs {
+				res = append(res, name)
+			}
+			sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+			if !reflect.DeepEqual(res, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+)
+
+// Layout defines how the objects are published.
+type Layout string
+
+const (
+	// LayoutLoose explodes all the packs into loose objects. Each object gets
+	// its own IPFS block.
+	LayoutLoose Layout = "loose"
+	// LayoutPacked keeps the packs, split into packs of at most MaxPackSize.
+	LayoutPacked Layout = "packed"
+	// LayoutHybrid keeps the packs bigger than HybridThreshold and explodes
+	// the smaller ones. The initial clone is kept packed while the
+	// incremental fetches end up as loose objects, the packs are then
+	// shared between the versions of a repository.
+	LayoutHybrid Layout = "hybrid"
+)
+
+func ParseLayout(s string) (Layout, error) {
+	switch layout := Layout(s); layout {
+	case LayoutLoose, LayoutPacked, LayoutHybrid:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("unknown layout %q", s)
+	}
+}
+
+// UnpackOptions configures the Unpacker.
+type UnpackOptions struct {
+	Layout Layout
+	// MaxPackSize is the maximum size in bytes of the kept packs, the bigger
+	// ones are split. 0 means no limit.
+	MaxPackSize int64
+	// HybridThreshold is the size in bytes from which a pack is kept with
+	// the hybrid layout.
+	HybridThreshold int64
+}
+
+// splitPack re-encodes the objects of a pack into several packs of
+// approximately maxSize bytes. The original pack is left untouched.
+func splitPack(ctx context.Context, storage *filesystem.Storage, dir *dotgit.DotGit, packHash plumbing.Hash, maxSize int64) error {
+	idxFile, err := dir.ObjectPackIdx(packHash)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the idx file for pack %q: %w", packHash, err)
+	}
+	defer func() { _ = idxFile.Close() }()
+
+	idx := idxfile.NewMemoryIndex()
+	err = idxfile.NewDecoder(idxFile).Decode(idx)
+	if err != nil {
+		return fmt.Errorf("failed to decode the idx file for pack %q: %w", packHash, err)
+	}
+
+	entries, err := idx.EntriesByOffset()
+	if err != nil {
+		return fmt.Errorf("failed to list the objects from pack %q: %w", packHash, err)
+	}
+	defer func() { _ = entries.Close() }()
+
+	objects := []*idxfile.Entry{}
+	for {
+		entry, err := entries.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list the objects from pack %q: %w", packHash, err)
+		}
+
+		objects = append(objects, entry)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Offset < objects[j].Offset
+	})
+
+	packStat, err := storage.Filesystem().Stat(packPath(packHash))
+	if err != nil {
+		return fmt.Errorf("failed to stat the pack %q: %w", packHash, err)
+	}
+
+	// The packed size of an object is estimated from the offset of the next
+	// one, the pack ending with a 20 bytes checksum.
+	var (
+		chunk     []plumbing.Hash
+		chunkSize int64
+	)
+
+	for i, entry := range objects {
+		end := packStat.Size() - 20
+		if i+1 < len(objects) {
+			end = int64(objects[i+1].Offset)
+		}
+		size := end - int64(entry.Offset)
+
+		if len(chunk) > 0 && chunkSize+size > maxSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err = encodePack(storage, dir, chunk)
+			if err != nil {
+				return err
+			}
+
+			chunk = nil
+			chunkSize = 0
+		}
+
+		chunk = append(chunk, entry.Hash)
+		chunkSize += size
+	}
+
+	if len(chunk) > 0 {
+		err = encodePack(storage, dir, chunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func encodePack(storage *filesystem.Storage, dir *dotgit.DotGit, hashes []plumbing.Hash) error {
+	writer, err := dir.NewObjectPack()
+	if err != nil {
+		return fmt.Errorf("failed to create a new pack: %w", err)
+	}
+
+	_, err = packfile.NewEncoder(writer, storage, false).Encode(hashes, 10)
+	if err != nil {
+		_ = writer.Close()
+		return fmt.Errorf("failed to encode the pack: %w", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to save the pack: %w", err)
+	}
+
+	return nil
+}
+
+func packPath(packHash plumbing.Hash) string {
+	return fmt.Sprintf("objects/pack/pack-%s.pack", packHash)
+}
@@ -0,0 +1,289 @@
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// ipfsChunkSize is the size of the blocks created by the default chunker of
+// "ipfs add".
+const ipfsChunkSize = 256 * 1024
+
+// layoutFixture is a generated repository with two versions. The objects of
+// each version are written as a pack, the same way a clone and then an
+// incremental fetch would.
+type layoutFixture struct {
+	objects *memory.Storage
+	v1      []plumbing.Hash
+	v2      []plumbing.Hash // the objects added by the second version
+}
+
+// newLayoutFixture generates a repository of nbFiles text files. The second
+// version modifies one file out of ten and adds a few new ones.
+func newLayoutFixture(tb testing.TB, nbFiles int) *layoutFixture {
+	tb.Helper()
+
+	objects := memory.NewStorage()
+	worktree := memfs.New()
+
+	repo, err := git.Init(objects, worktree)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(42))
+	words := make([]string, 2000)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%x", r.Int63())[:2+r.Intn(10)]
+	}
+
+	writeFile := func(name string, nbLines int, appendOnly bool) {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if appendOnly {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+
+		f, err := worktree.OpenFile(name, flags, 0644)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer f.Close()
+
+		for i := 0; i < nbLines; i++ {
+			line := make([]string, 8+r.Intn(8))
+			for j := range line {
+				line[j] = words[r.Intn(len(words))]
+			}
+
+			_, err = io.WriteString(f, strings.Join(line, " ")+"\n")
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+
+	commit := func(msg string) {
+		_, err = wt.Add(".")
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		_, err = wt.Commit(msg, &git.CommitOptions{
+			Author: &object.Signature{Name: "bench", Email: "bench@example.com", When: time.Unix(1649116800, 0)},
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	for i := 0; i < nbFiles; i++ {
+		writeFile(fmt.Sprintf("dir%d/file%d.txt", i%10, i), 50+r.Intn(200), false)
+	}
+	commit("first version")
+
+	v1 := listObjects(tb, objects)
+
+	for i := 0; i < nbFiles; i += 10 {
+		writeFile(fmt.Sprintf("dir%d/file%d.txt", i%10, i), 20, true)
+	}
+	for i := nbFiles; i < nbFiles+nbFiles/20; i++ {
+		writeFile(fmt.Sprintf("dir%d/file%d.txt", i%10, i), 50+r.Intn(200), false)
+	}
+	commit("second version")
+
+	known := make(map[plumbing.Hash]bool, len(v1))
+	for _, hash := range v1 {
+		known[hash] = true
+	}
+
+	v2 := []plumbing.Hash{}
+	for _, hash := range listObjects(tb, objects) {
+		if !known[hash] {
+			v2 = append(v2, hash)
+		}
+	}
+
+	return &layoutFixture{objects, v1, v2}
+}
+
+func listObjects(tb testing.TB, objects *memory.Storage) []plumbing.Hash {
+	tb.Helper()
+
+	iter, err := objects.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	res := []plumbing.Hash{}
+	err = iter.ForEach(func(obj plumbing.EncodedObject) error {
+		res = append(res, obj.Hash())
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return res
+}
+
+// writePack writes the given objects as a new pack inside storage.
+func (f *layoutFixture) writePack(tb testing.TB, storage *filesystem.Storage, hashes []plumbing.Hash) {
+	tb.Helper()
+
+	writer, err := dotgit.New(storage.Filesystem()).NewObjectPack()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	_, err = packfile.NewEncoder(writer, f.objects, false).Encode(hashes, 10)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	storage.Reindex()
+}
+
+// ipfsBlocks chunks every file under dir like "ipfs add" and returns the
+// size of every block by content hash.
+func ipfsBlocks(tb testing.TB, dir string) map[[sha256.Size]byte]int {
+	tb.Helper()
+
+	res := map[[sha256.Size]byte]int{}
+	buf := make([]byte, ipfsChunkSize)
+
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		for {
+			n, err := io.ReadFull(f, buf)
+			if n > 0 {
+				res[sha256.Sum256(buf[:n])] = n
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return res
+}
+
+// BenchmarkUnpackLayouts applies every layout to a first version of a
+// repository then to a second one fetched on top of it. Besides the time of
+// the two unpacks, it reports the IPFS blocks of each version, the blocks
+// shared between them, the size of the new blocks which is the size uploaded
+// for the second version, and the time to chunk and hash the second version
+// as "ipfs add" does.
+func BenchmarkUnpackLayouts(b *testing.B) {
+	fixture := newLayoutFixture(b, 500)
+
+	layouts := []UnpackOptions{
+		{Layout: LayoutLoose},
+		{Layout: LayoutPacked},
+		{Layout: LayoutPacked, MaxPackSize: 512 * 1024},
+		{Layout: LayoutHybrid, HybridThreshold: 1024 * 1024},
+	}
+
+	for _, opts := range layouts {
+		name := string(opts.Layout)
+		if opts.MaxPackSize > 0 {
+			name += "-split"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			unpacker := NewUnpacker(opts)
+
+			var (
+				v1, v2  map[[sha256.Size]byte]int
+				addTime time.Duration
+			)
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir := b.TempDir()
+				storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+				fixture.writePack(b, storage, fixture.v1)
+				b.StartTimer()
+
+				err := unpacker.Unpack(context.Background(), storage)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				v1 = ipfsBlocks(b, dir)
+				fixture.writePack(b, storage, fixture.v2)
+				b.StartTimer()
+
+				err = unpacker.Unpack(context.Background(), storage)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				start := time.Now()
+				v2 = ipfsBlocks(b, dir)
+				addTime += time.Since(start)
+				b.StartTimer()
+			}
+
+			shared, newBytes := 0, 0
+			for hash, size := range v2 {
+				if _, ok := v1[hash]; ok {
+					shared++
+				} else {
+					newBytes += size
+				}
+			}
+
+			b.ReportMetric(float64(len(v1)), "v1-blocks")
+			b.ReportMetric(float64(len(v2)), "v2-blocks")
+			b.ReportMetric(float64(shared), "shared-blocks")
+			b.ReportMetric(float64(newBytes)/1024, "uploaded-KiB")
+			b.ReportMetric(float64(addTime.Milliseconds())/float64(b.N), "add-ms")
+		})
+	}
+}
@@ -0,0 +1,560 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const (
+	// LFSObjectsDir is the directory where the LFS objects are stored, with
+	// the same layout than git-lfs: lfs/objects/<oid[0:2]>/<oid[2:4]>/<oid>.
+	LFSObjectsDir = "lfs/objects"
+	lfsTmpDir     = "lfs/tmp"
+
+	// lfsPointerMaxSize is the maximum size of a pointer file, the bigger
+	// blobs are never read.
+	lfsPointerMaxSize = 1024
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	lfsBatchSize      = 100
+	lfsMediaType      = "application/vnd.git-lfs+json"
+)
+
+// LFSObject is an object referenced by a LFS pointer file.
+type LFSObject struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// LFSFetcher downloads the LFS objects of a repository with the LFS batch
+// API.
+//
+// The timeout bounds the batch requests and the wait for the download
+// response headers, the downloads themselves are not bounded as the objects
+// can be big. The failing requests are retried with the retry policy.
+type LFSFetcher struct {
+	client  *http.Client
+	timeout time.Duration
+	retry   metadata.RetryPolicy
+	creds   *Credentials
+}
+
+func NewLFSFetcher(creds *Credentials, timeout time.Duration, retry metadata.RetryPolicy) *LFSFetcher {
+	if creds == nil {
+		creds = NewCredentials(nil)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+
+	return &LFSFetcher{
+		client:  &http.Client{Transport: transport},
+		timeout: timeout,
+		retry:   retry,
+		creds:   creds,
+	}
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []LFSObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []struct {
+		LFSObject
+		Actions struct {
+			Download *lfsAction `json:"download"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+// FetchObjects downloads into LFSObjectsDir the objects referenced by the
+// pointer files at the tip of every reference. The objects already present,
+// retrieved with a previous version of the repository, are not downloaded
+// again. It returns the number of objects present in LFSObjectsDir.
+//
+// The objects unavailable upstream are logged and skipped, as a checkout of
+// the upstream repository they are left as pointer files. The objects not
+// referenced anymore are removed.
+func (f *LFSFetcher) FetchObjects(ctx context.Context, repoURL string, storage *filesystem.Storage) (int, error) {
+	objects, err := findLFSObjects(storage)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the LFS pointers: %w", err)
+	}
+
+	fs := storage.Filesystem()
+
+	err = pruneLFSObjects(fs, objects)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(objects) == 0 {
+		return 0, nil
+	}
+
+	missing := []LFSObject{}
+	for _, obj := range objects {
+		_, err := fs.Stat(lfsObjectPath(obj.OID))
+		if errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, obj)
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat the LFS object %s: %w", obj.OID, err)
+		}
+	}
+
+	log.Printf("%d LFS objects referenced, %d to download", len(objects), len(missing))
+
+	endpoint, err := lfsBatchURL(repoURL)
+	if err != nil {
+		return 0, err
+	}
+
+	auth, err := f.creds.AuthFor(repoURL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve the credentials: %w", err)
+	}
+
+	nbPresent := len(objects) - len(missing)
+
+	for start := 0; start < len(missing); start += lfsBatchSize {
+		end := start + lfsBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		requested := map[string]LFSObject{}
+		for _, obj := range missing[start:end] {
+			requested[obj.OID] = obj
+		}
+
+		var res *lfsBatchResponse
+		err = f.retry.Do(ctx, "LFS batch request", func() (time.Duration, error) {
+			var err error
+			res, err = f.batch(ctx, endpoint, auth, missing[start:end])
+			return 0, err
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		for _, obj := range res.Objects {
+			// Only the requested objects are accepted, the oid is used as
+			// a file path.
+			expected, ok := requested[obj.OID]
+			if !ok {
+				log.Printf("unexpected LFS object %q in the batch response, ignore it", obj.OID)
+				continue
+			}
+
+			if obj.Error != nil {
+				log.Printf("LFS object %s unavailable, skip it: %d %s", obj.OID, obj.Error.Code, obj.Error.Message)
+				continue
+			}
+
+			if obj.Actions.Download == nil {
+				log.Printf("no download action for the LFS object %s, skip it", obj.OID)
+				continue
+			}
+
+			err = f.retry.Do(ctx, fmt.Sprintf("download of the LFS object %s", obj.OID), func() (time.Duration, error) {
+				return 0, f.download(ctx, fs, expected, obj.Actions.Download)
+			})
+			if err != nil {
+				return 0, fmt.Errorf("failed to download the LFS object %s: %w", obj.OID, err)
+			}
+
+			nbPresent++
+		}
+	}
+
+	return nbPresent, nil
+}
+
+func (f *LFSFetcher) batch(ctx context.Context, endpoint string, auth transport.AuthMethod, objects []LFSObject) (*lfsBatchResponse, error) {
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   objects,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the batch request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the batch request: %w", err)
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+
+	if basic, ok := auth.(*githttp.BasicAuth); ok {
+		req.SetBasicAuth(basic.Username, basic.Password)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send the batch request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid batch response: %w", &metadata.StatusError{
+			URL:        endpoint,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		})
+	}
+
+	res := lfsBatchResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the batch response: %w", err)
+	}
+
+	return &res, nil
+}
+
+// download streams an object into a temporary file and moves it into
+// LFSObjectsDir once its size and hash are checked.
+func (f *LFSFetcher) download(ctx context.Context, fs billy.Filesystem, obj LFSObject, action *lfsAction) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, action.Href, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	for key, value := range action.Header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send the request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &metadata.StatusError{
+			URL:        action.Href,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	err = fs.MkdirAll(lfsTmpDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create the %s directory: %w", lfsTmpDir, err)
+	}
+
+	tmp, err := util.TempFile(fs, lfsTmpDir, obj.OID)
+	if err != nil {
+		return fmt.Errorf("failed to create the temporary file: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), resp.Body)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && size != obj.Size {
+		err = fmt.Errorf("invalid size: expected %d, got %d", obj.Size, size)
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); err == nil && sum != obj.OID {
+		err = fmt.Errorf("invalid hash: got %s", sum)
+	}
+	if err != nil {
+		_ = fs.Remove(tmpName)
+		return err
+	}
+
+	objPath := lfsObjectPath(obj.OID)
+
+	err = fs.MkdirAll(path.Dir(objPath), 0755)
+	if err != nil {
+		_ = fs.Remove(tmpName)
+		return fmt.Errorf("failed to create the object directory: %w", err)
+	}
+
+	err = fs.Rename(tmpName, objPath)
+	if err != nil {
+		_ = fs.Remove(tmpName)
+		return fmt.Errorf("failed to move the object: %w", err)
+	}
+
+	return nil
+}
+
+// pruneLFSObjects removes from LFSObjectsDir the objects which are not in
+// the given list, the whole directory if the list is empty.
+func pruneLFSObjects(fs billy.Filesystem, objects []LFSObject) error {
+	if len(objects) == 0 {
+		err := util.RemoveAll(fs, LFSObjectsDir)
+		if err != nil {
+			return fmt.Errorf("failed to remove the %s directory: %w", LFSObjectsDir, err)
+		}
+
+		return nil
+	}
+
+	referenced := make(map[string]struct{}, len(objects))
+	for _, obj := range objects {
+		referenced[lfsObjectPath(obj.OID)] = struct{}{}
+	}
+
+	err := removeNotReferenced(fs, LFSObjectsDir, referenced)
+	if err != nil {
+		return fmt.Errorf("failed to remove the LFS objects not referenced anymore: %w", err)
+	}
+
+	return nil
+}
+
+// removeNotReferenced removes recursively the files of dir which are not in
+// referenced.
+func removeNotReferenced(fs billy.Filesystem, dir string, referenced map[string]struct{}) error {
+	entries, err := fs.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryPath := path.Join(dir, entry.Name())
+
+		if entry.IsDir() {
+			err = removeNotReferenced(fs, entryPath, referenced)
+		} else if _, ok := referenced[entryPath]; !ok {
+			err = fs.Remove(entryPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findLFSObjects lists the objects referenced by the pointer files at the tip
+// of every reference.
+func findLFSObjects(storage *filesystem.Storage) ([]LFSObject, error) {
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an iterator on references: %w", err)
+	}
+
+	res := []LFSObject{}
+	found := map[string]struct{}{}
+	// The trees and blobs are shared between the references, they are only
+	// read once.
+	seenTrees := map[plumbing.Hash]bool{}
+	seenBlobs := map[plumbing.Hash]struct{}{}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		target, err := peelTag(storage, ref.Hash())
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", ref.Name(), err)
+		}
+
+		commit, err := object.GetCommit(storage, target)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the commit of %s: %w", ref.Name(), err)
+		}
+
+		tree, err := commit.Tree()
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the tree of %s: %w", ref.Name(), err)
+		}
+
+		walker := object.NewTreeWalker(tree, true, seenTrees)
+		defer walker.Close()
+
+		for {
+			name, entry, err := walker.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to walk the tree of %s: %w", ref.Name(), err)
+			}
+
+			if !entry.Mode.IsFile() || entry.Mode == filemode.Symlink {
+				continue
+			}
+
+			if _, ok := seenBlobs[entry.Hash]; ok {
+				continue
+			}
+			seenBlobs[entry.Hash] = struct{}{}
+
+			obj, err := readLFSPointer(storage, entry.Hash)
+			if err != nil {
+				return fmt.Errorf("failed to read %q in %s: %w", name, ref.Name(), err)
+			}
+
+			if obj == nil {
+				continue
+			}
+
+			if _, ok := found[obj.OID]; !ok {
+				found[obj.OID] = struct{}{}
+				res = append(res, *obj)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// readLFSPointer returns the object referenced by the given blob or nil if
+// the blob isn't a pointer file.
+func readLFSPointer(storage *filesystem.Storage, hash plumbing.Hash) (*LFSObject, error) {
+	size, err := storage.EncodedObjectSize(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > lfsPointerMaxSize {
+		return nil, nil
+	}
+
+	blob, err := object.GetBlob(storage, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLFSPointer(content), nil
+}
+
+// parseLFSPointer parses a pointer file as described in
+// https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md. It returns nil
+// if the content isn't a valid pointer.
+func parseLFSPointer(content []byte) *LFSObject {
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) < 3 || lines[0] != lfsPointerVersion {
+		return nil
+	}
+
+	obj := LFSObject{Size: -1}
+
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil
+		}
+
+		switch key {
+		case "oid":
+			oid := strings.TrimPrefix(value, "sha256:")
+			if len(oid) != sha256.Size*2 || oid == value {
+				return nil
+			}
+
+			_, err := hex.DecodeString(oid)
+			if err != nil {
+				return nil
+			}
+
+			obj.OID = strings.ToLower(oid)
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil
+			}
+
+			obj.Size = size
+		}
+	}
+
+	if obj.OID == "" || obj.Size < 0 {
+		return nil
+	}
+
+	return &obj
+}
+
+func lfsObjectPath(oid string) string {
+	return path.Join(LFSObjectsDir, oid[0:2], oid[2:4], oid)
+}
+
+// lfsBatchURL returns the url of the batch API of a repository, as git-lfs
+// does without any lfs.url configuration.
+func lfsBatchURL(repoURL string) (string, error) {
+	u, err := stripURLCredentials(repoURL)
+	if err != nil {
+		return "", err
+	}
+
+	u = strings.TrimSuffix(u, "/")
+	if !strings.HasSuffix(u, ".git") {
+		u += ".git"
+	}
+
+	return u + "/info/lfs/objects/batch", nil
+}
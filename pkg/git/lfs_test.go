@@ -0,0 +1,367 @@
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// newLFSServer serves the batch API of the "team/repo" repository and the
+// download of the given objects. The other objects are reported as missing.
+// The batch requests must be authenticated with the "secret" token, the
+// first ones fail with the given statuses.
+func newLFSServer(t *testing.T, objects map[string][]byte, batchStatuses ...int) (*httptest.Server, *int) {
+	t.Helper()
+
+	nbDownloads := 0
+	nbBatches := 0
+	mux := http.NewServeMux()
+
+	var srv *httptest.Server
+
+	mux.HandleFunc("/team/repo.git/info/lfs/objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		if _, password, _ := r.BasicAuth(); password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		nbBatches++
+		if nbBatches <= len(batchStatuses) {
+			http.Error(w, "failure", batchStatuses[nbBatches-1])
+			return
+		}
+
+		req := lfsBatchRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Operation != "download" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		res := map[string][]interface{}{"objects": {}}
+		for _, obj := range req.Objects {
+			if _, ok := objects[obj.OID]; !ok {
+				res["objects"] = append(res["objects"], map[string]interface{}{
+					"oid":   obj.OID,
+					"size":  obj.Size,
+					"error": map[string]interface{}{"code": 404, "message": "Object does not exist"},
+				})
+				continue
+			}
+
+			res["objects"] = append(res["objects"], map[string]interface{}{
+				"oid":  obj.OID,
+				"size": obj.Size,
+				"actions": map[string]interface{}{
+					"download": map[string]interface{}{
+						"href":   srv.URL + "/objects/" + obj.OID,
+						"header": map[string]string{"X-Download-Token": "download-" + obj.OID},
+					},
+				},
+			})
+		}
+
+		w.Header().Set("Content-Type", lfsMediaType)
+		_ = json.NewEncoder(w).Encode(res)
+	})
+
+	mux.HandleFunc("/objects/", func(w http.ResponseWriter, r *http.Request) {
+		oid := strings.TrimPrefix(r.URL.Path, "/objects/")
+		content, ok := objects[oid]
+		if !ok || r.Header.Get("X-Download-Token") != "download-"+oid {
+			http.NotFound(w, r)
+			return
+		}
+
+		nbDownloads++
+		_, _ = w.Write(content)
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv, &nbDownloads
+}
+
+// newLFSRepository creates a repository whose single commit contains a
+// pointer file for each given content and a regular file.
+func newLFSRepository(t *testing.T, contents ...[]byte) (*filesystem.Storage, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+
+	writeBlob := func(content []byte) plumbing.Hash {
+		obj := storage.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+
+		w, err := obj.Writer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(content)
+		_ = w.Close()
+
+		hash, err := storage.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	tree := &object.Tree{}
+	tree.Entries = append(tree.Entries, object.TreeEntry{
+		Name: "README.md",
+		Mode: filemode.Regular,
+		Hash: writeBlob([]byte("# Some repository\n")),
+	})
+
+	for i, content := range contents {
+		sum := sha256.Sum256(content)
+		pointer := fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, hex.EncodeToString(sum[:]), len(content))
+
+		tree.Entries = append(tree.Entries, object.TreeEntry{
+			Name: fmt.Sprintf("asset%d.bin", i),
+			Mode: filemode.Regular,
+			Hash: writeBlob([]byte(pointer)),
+		})
+	}
+
+	treeObj := storage.NewEncodedObject()
+	err := tree.Encode(treeObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	treeHash, err := storage.SetEncodedObject(treeObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1649116800, 0)}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: "add the assets", TreeHash: treeHash}
+
+	commitObj := storage.NewEncodedObject()
+	err = commit.Encode(commitObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitHash, err := storage.SetEncodedObject(commitObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.SetReference(plumbing.NewHashReference(plumbing.Master, commitHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage, dir
+}
+
+// testRetryPolicy retries quickly.
+var testRetryPolicy = metadata.RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond}
+
+// newTestLFSFetcher returns a fetcher authenticated on the host of a
+// newLFSServer.
+func newTestLFSFetcher(host string) *LFSFetcher {
+	return NewLFSFetcher(NewCredentials(map[string]HostCredentials{
+		host: {Type: CredentialsToken, Password: "secret"},
+	}), time.Second, testRetryPolicy)
+}
+
+func TestLFSFetcherFetchObjects(t *testing.T) {
+	available := []byte("some large binary content")
+	unavailable := []byte("an object missing upstream")
+
+	sum := sha256.Sum256(available)
+	oid := hex.EncodeToString(sum[:])
+
+	srv, nbDownloads := newLFSServer(t, map[string][]byte{oid: available})
+	storage, dir := newLFSRepository(t, available, unavailable)
+
+	host := strings.Split(strings.TrimPrefix(srv.URL, "http://"), ":")[0]
+	fetcher := newTestLFSFetcher(host)
+
+	nbObjects, err := fetcher.FetchObjects(context.Background(), srv.URL+"/team/repo", storage)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The unavailable object is skipped.
+	if nbObjects != 1 {
+		t.Errorf("expected 1 object, got %d", nbObjects)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, LFSObjectsDir, oid[0:2], oid[2:4], oid))
+	if err != nil {
+		t.Fatalf("the object isn't stored: %s", err)
+	}
+
+	if string(content) != string(available) {
+		t.Errorf("invalid object content: %q", content)
+	}
+
+	// The objects already present are not downloaded again.
+	nbObjects, err = fetcher.FetchObjects(context.Background(), srv.URL+"/team/repo", storage)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if nbObjects != 1 || *nbDownloads != 1 {
+		t.Errorf("expected 1 object downloaded once, got %d objects and %d downloads", nbObjects, *nbDownloads)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, lfsTmpDir))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected no temporary file left, got %v %v", entries, err)
+	}
+}
+
+func TestLFSFetcherFetchObjectsUnauthorized(t *testing.T) {
+	srv, _ := newLFSServer(t, nil)
+	storage, _ := newLFSRepository(t, []byte("content"))
+
+	_, err := NewLFSFetcher(nil, time.Second, testRetryPolicy).FetchObjects(context.Background(), srv.URL+"/team/repo", storage)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the batch request to be rejected, got %v", err)
+	}
+}
+
+func TestLFSFetcherFetchObjectsRetry(t *testing.T) {
+	content := []byte("some large binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		statuses []int
+		err      bool
+	}{
+		{name: "transient failures", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}},
+		{name: "too many failures", statuses: []int{502, 502, 502}, err: true},
+		{name: "final failure", statuses: []int{http.StatusNotFound}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, _ := newLFSServer(t, map[string][]byte{oid: content}, test.statuses...)
+			storage, _ := newLFSRepository(t, content)
+
+			host := strings.Split(strings.TrimPrefix(srv.URL, "http://"), ":")[0]
+
+			nbObjects, err := newTestLFSFetcher(host).FetchObjects(context.Background(), srv.URL+"/team/repo", storage)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %d objects", nbObjects)
+				}
+				return
+			}
+
+			if err != nil || nbObjects != 1 {
+				t.Errorf("expected 1 object, got %d, %v", nbObjects, err)
+			}
+		})
+	}
+}
+
+func TestLFSFetcherFetchObjectsPrune(t *testing.T) {
+	content := []byte("some large binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	stale := strings.Repeat("ab", sha256.Size)
+
+	srv, _ := newLFSServer(t, map[string][]byte{oid: content})
+	host := strings.Split(strings.TrimPrefix(srv.URL, "http://"), ":")[0]
+
+	writeStale := func(dir string) string {
+		t.Helper()
+
+		stalePath := filepath.Join(dir, LFSObjectsDir, stale[0:2], stale[2:4], stale)
+		err := os.MkdirAll(filepath.Dir(stalePath), 0755)
+		if err == nil {
+			err = os.WriteFile(stalePath, []byte("stale"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return stalePath
+	}
+
+	// The objects not referenced anymore are removed.
+	storage, dir := newLFSRepository(t, content)
+	stalePath := writeStale(dir)
+
+	nbObjects, err := newTestLFSFetcher(host).FetchObjects(context.Background(), srv.URL+"/team/repo", storage)
+	if err != nil || nbObjects != 1 {
+		t.Fatalf("expected 1 object, got %d, %v", nbObjects, err)
+	}
+
+	if _, err := os.Stat(stalePath); !os.IsNotExist(err) {
+		t.Errorf("expected the stale object to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, LFSObjectsDir, oid[0:2], oid[2:4], oid)); err != nil {
+		t.Errorf("expected the referenced object to be kept, got %s", err)
+	}
+
+	// A repository without pointer doesn't keep any LFS directory.
+	storage, dir = newLFSRepository(t)
+	writeStale(dir)
+
+	nbObjects, err = newTestLFSFetcher(host).FetchObjects(context.Background(), srv.URL+"/team/repo", storage)
+	if err != nil || nbObjects != 0 {
+		t.Fatalf("expected no object, got %d, %v", nbObjects, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, LFSObjectsDir)); !os.IsNotExist(err) {
+		t.Errorf("expected the %s directory to be removed, got %v", LFSObjectsDir, err)
+	}
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	oid := strings.Repeat("ab", sha256.Size)
+
+	tests := []struct {
+		content  string
+		expected *LFSObject
+	}{
+		{
+			content:  lfsPointerVersion + "\noid sha256:" + oid + "\nsize 12345\n",
+			expected: &LFSObject{OID: oid, Size: 12345},
+		},
+		{content: "oid sha256:" + oid + "\nsize 12345\n"},
+		{content: lfsPointerVersion + "\noid sha256:1234\nsize 12345\n"},
+		{content: lfsPointerVersion + "\noid md5:" + oid + "\nsize 12345\n"},
+		{content: lfsPointerVersion + "\noid sha256:" + oid + "\nsize -1\n"},
+		{content: "some regular file"},
+	}
+
+	for _, test := range tests {
+		res := parseLFSPointer([]byte(test.content))
+
+		if (res == nil) != (test.expected == nil) || (res != nil && *res != *test.expected) {
+			t.Errorf("%q: expected %+v, got %+v", test.content, test.expected, res)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package git
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const remoteRefPrefix = "refs/remotes/origin/"
+
+// bareConfig is the config published with every repository. It doesn't
+// contain any remote or local setting.
+const bareConfig = `[core]
+	repositoryformatversion = 0
+	bare = true
+`
+
+// DefaultAllowedPaths are the paths of a bare repository served over the
+// dumb HTTP protocol, plus the LFS objects and the bundles.
+var DefaultAllowedPaths = []string{"HEAD", "config", "description", "packed-refs", "info", "objects", "refs", "lfs", "bundles"}
+
+// DefaultDeniedPaths are the local-only paths which could be present inside
+// the allowed ones.
+var DefaultDeniedPaths = []string{"refs/remotes", "objects/tmp_*", "objects/pack/tmp_*", "lfs/tmp", "bundles/tmp_*"}
+
+// SanitizeOptions selects the published paths.
+//
+// The patterns use the path.Match syntax on the slash separated path relative
+// to the repository root. A pattern matching a directory matches all its
+// content. The denied patterns take precedence over the allowed ones.
+type SanitizeOptions struct {
+	Allow []string
+	Deny  []string
+}
+
+// Sanitizer transforms a fetched repository into a clean bare repository
+// ready to be published.
+type Sanitizer struct {
+	opts SanitizeOptions
+}
+
+func NewSanitizer(opts SanitizeOptions) *Sanitizer {
+	return &Sanitizer{opts}
+}
+
+// Sanitize moves the "refs/remotes/origin/*" references to "refs/heads/*",
+// replaces the config and the description and removes all the paths which
+// are not allowed.
+func (s *Sanitizer) Sanitize(storage *filesystem.Storage, description string) error {
+	err := s.moveRemoteRefs(storage)
+	if err != nil {
+		return err
+	}
+
+	fs := storage.Filesystem()
+
+	err = util.WriteFile(fs, "config", []byte(bareConfig), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write the config: %w", err)
+	}
+
+	err = util.WriteFile(fs, "description", []byte(description+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write the description: %w", err)
+	}
+
+	err = s.removeNotAllowed(fs, "")
+	if err != nil {
+		return err
+	}
+
+	return s.removeDenied(fs)
+}
+
+func (s *Sanitizer) moveRemoteRefs(storage *filesystem.Storage) error {
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return fmt.Errorf("failed to create an iterator on references: %w", err)
+	}
+
+	remoteRefs := []*plumbing.Reference{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), remoteRefPrefix) {
+			remoteRefs = append(remoteRefs, ref)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list the references: %w", err)
+	}
+
+	for _, ref := range remoteRefs {
+		name := plumbing.NewBranchReferenceName(strings.TrimPrefix(ref.Name().String(), remoteRefPrefix))
+
+		err = storage.SetReference(plumbing.NewHashReference(name, ref.Hash()))
+		if err != nil {
+			return fmt.Errorf("failed to create the ref %q: %w", name, err)
+		}
+
+		err = storage.RemoveReference(ref.Name())
+		if err != nil {
+			return fmt.Errorf("failed to remove the ref %q: %w", ref.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// removeNotAllowed removes recursively all the paths not allowed.
+func (s *Sanitizer) removeNotAllowed(fs billy.Filesystem, dir string) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read the dir %q: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		entryPath := path.Join(dir, entry.Name())
+
+		if matchAny(s.opts.Allow, entryPath) {
+			continue
+		}
+
+		if entry.IsDir() && hasPatternInside(s.opts.Allow, entryPath) {
+			err = s.removeNotAllowed(fs, entryPath)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		err = util.RemoveAll(fs, entryPath)
+		if err != nil {
+			return fmt.Errorf("failed to remove %q: %w", entryPath, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Sanitizer) removeDenied(fs billy.Filesystem) error {
+	for _, pattern := range s.opts.Deny {
+		matches, err := util.Glob(fs, pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+
+		for _, match := range matches {
+			err = util.RemoveAll(fs, match)
+			if err != nil {
+				return fmt.Errorf("failed to remove %q: %w", match, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchAny returns true if filePath or one of its parents matches a pattern.
+func matchAny(patterns []string, filePath string) bool {
+	for p := filePath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasPatternInside returns true if a pattern targets a path inside dir.
+func hasPatternInside(patterns []string, dir string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,234 @@
+package git
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// listFiles returns the slash separated path of every file inside dir.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	res := []string{}
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		res = append(res, filepath.ToSlash(rel))
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+func TestSanitizerMoveRemoteRefs(t *testing.T) {
+	tests := []struct {
+		name     string
+		refs     []plumbing.ReferenceName
+		expected []plumbing.ReferenceName
+	}{
+		{
+			name:     "remotes",
+			refs:     []plumbing.ReferenceName{"refs/remotes/origin/master", "refs/remotes/origin/feat/a"},
+			expected: []plumbing.ReferenceName{"refs/heads/feat/a", "refs/heads/master"},
+		},
+		{
+			name:     "mirror",
+			refs:     []plumbing.ReferenceName{"refs/heads/master", "refs/tags/v1"},
+			expected: []plumbing.ReferenceName{"refs/heads/master", "refs/tags/v1"},
+		},
+		{
+			name:     "other remote",
+			refs:     []plumbing.ReferenceName{"refs/remotes/origin/master", "refs/remotes/fork/master", "refs/pull/1/head"},
+			expected: []plumbing.ReferenceName{"refs/heads/master", "refs/pull/1/head", "refs/remotes/fork/master"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := newLocalStorage(t)
+			commit := commitFile(t, storage, plumbing.ZeroHash, "content")
+
+			err := storage.RemoveReference(plumbing.Master)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range test.refs {
+				err := storage.SetReference(plumbing.NewHashReference(name, commit))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = storage.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = NewSanitizer(SanitizeOptions{}).moveRemoteRefs(storage)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			refs, err := snapshotRefs(storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := []plumbing.ReferenceName{}
+			for name, hash := range refs {
+				if hash != commit {
+					t.Errorf("expected %s to point to %s, got %s", name, commit, hash)
+				}
+				res = append(res, name)
+			}
+			sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+
+			if !reflect.DeepEqual(res, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, res)
+			}
+
+			head, err := storage.Reference(plumbing.HEAD)
+			if err != nil || head.Type() != plumbing.SymbolicReference || head.Target() != plumbing.Master {
+				t.Errorf("expected the HEAD to be kept, got %v, %v", head, err)
+			}
+		})
+	}
+}
+
+func TestSanitizerSanitize(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     SanitizeOptions
+		expected []string
+	}{
+		{
+			name: "default",
+			opts: SanitizeOptions{Allow: DefaultAllowedPaths, Deny: DefaultDeniedPaths},
+			expected: []string{
+				"HEAD",
+				"bundles/full.bundle",
+				"config",
+				"description",
+				"lfs/objects/aa/bb/aabb",
+				"objects/pack/pack-1.pack",
+				"refs/heads/master",
+			},
+		},
+		{
+			name: "deny wins over allow",
+			opts: SanitizeOptions{Allow: []string{"HEAD", "refs", "objects", "lfs"}, Deny: []string{"lfs", "refs/remotes", "objects/pack/*.pack"}},
+			expected: []string{
+				"HEAD",
+				"objects/pack/tmp_pack_1",
+				"objects/tmp_obj_1",
+				"refs/heads/master",
+			},
+		},
+		{
+			name: "pattern inside a dir",
+			opts: SanitizeOptions{Allow: []string{"HEAD", "refs/heads", "lfs/objects/*"}},
+			expected: []string{
+				"HEAD",
+				"lfs/objects/aa/bb/aabb",
+				"refs/heads/master",
+			},
+		},
+	}
+
+	files := []string{
+		"FETCH_HEAD",
+		"hooks/pre-commit.sample",
+		"logs/HEAD",
+		"objects/tmp_obj_1",
+		"objects/pack/pack-1.pack",
+		"objects/pack/tmp_pack_1",
+		"lfs/tmp/upload",
+		"lfs/objects/aa/bb/aabb",
+		"bundles/full.bundle",
+		"bundles/tmp_1",
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+
+			for _, file := range files {
+				err := os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0755)
+				if err == nil {
+					err = os.WriteFile(filepath.Join(dir, file), []byte(file), 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := storage.SetReference(plumbing.NewHashReference("refs/remotes/origin/master", plumbing.NewHash("b8e471f58bcbca63b07bda20e428190409c2db47")))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = storage.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = NewSanitizer(test.opts).Sanitize(storage, "owner/repo")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			res := listFiles(t, dir)
+			if !reflect.DeepEqual(res, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, res)
+			}
+		})
+	}
+}
+
+func TestSanitizerSanitizeContent(t *testing.T) {
+	dir := t.TempDir()
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+
+	err := os.WriteFile(filepath.Join(dir, "config"), []byte("[remote \"origin\"]\n\turl = https://token@github.com/owner/repo\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewSanitizer(SanitizeOptions{Allow: DefaultAllowedPaths, Deny: DefaultDeniedPaths}).Sanitize(storage, "owner/repo")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	config, err := os.ReadFile(filepath.Join(dir, "config"))
+	if err != nil || string(config) != bareConfig {
+		t.Errorf("expected the config to be replaced, got %q, %v", config, err)
+	}
+
+	description, err := os.ReadFile(filepath.Join(dir, "description"))
+	if err != nil || string(description) != "owner/repo\n" {
+		t.Errorf("expected the description to be replaced, got %q, %v", description, err)
+	}
+}
@@ -1,53 +1,189 @@
 package git
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
 )
 
-type ServerInfoUpdater struct {
-}
+// ServerInfoUpdater generates the files required by the dumb HTTP protocol,
+// the same way than "git update-server-info".
+type ServerInfoUpdater struct{}
 
 func NewServerInfoUpdater() *ServerInfoUpdater {
 	return &ServerInfoUpdater{}
 }
 
-func (s *ServerInfoUpdater) UpdateServerInfo(storage *filesystem.Storage) error {
-	err := storage.Filesystem().MkdirAll("info", 0755)
+func (s *ServerInfoUpdater) UpdateServerInfo(ctx context.Context, storage *filesystem.Storage) error {
+	err := s.updateInfoRefs(storage)
 	if err != nil {
-		return fmt.Errorf("failed to create the info folder: %w", err)
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	refsFile, err := storage.Filesystem().Create("info/refs")
+	err = s.updateInfoPacks(storage)
 	if err != nil {
-		return fmt.Errorf("failed to create the refs file: %w", err)
+		return err
 	}
 
+	return nil
+}
+
+func (s *ServerInfoUpdater) updateInfoRefs(storage *filesystem.Storage) error {
 	refs, err := storage.IterReferences()
 	if err != nil {
 		return fmt.Errorf("failed to create an iterator on references: %w", err)
 	}
 
+	hashes := map[string]plumbing.Hash{}
+
 	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		if ref.Type() != plumbing.HashReference {
+		if ref.Type() != plumbing.HashReference || ref.Name() == plumbing.HEAD {
 			return nil
 		}
 
-		newName := strings.Replace(ref.Name().String(), "refs/remotes/origin/", "refs/heads/", -1)
+		hashes[ref.Name().String()] = ref.Hash()
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list the references: %w", err)
+	}
+
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		_, err := refsFile.Write([]byte(fmt.Sprintf("%s\t%s\n", ref.Hash(), newName)))
+	content := strings.Builder{}
+
+	for _, name := range names {
+		hash := hashes[name]
+
+		content.WriteString(fmt.Sprintf("%s\t%s\n", hash, name))
+
+		peeled, err := peelTag(storage, hash)
 		if err != nil {
-			return fmt.Errorf("failed to append a ref to the \"info/refs\" file: %w", err)
+			return fmt.Errorf("failed to peel the ref %q: %w", name, err)
 		}
 
-		return nil
-	})
+		if peeled != hash {
+			content.WriteString(fmt.Sprintf("%s\t%s^{}\n", peeled, name))
+		}
+	}
+
+	err = writeInfoFile(storage, "info/refs", content.String())
 	if err != nil {
-		return fmt.Errorf("failed to populate the \"info/refs\" file: %w", err)
+		return fmt.Errorf("failed to write the \"info/refs\" file: %w", err)
 	}
 
 	return nil
 }
+
+func (s *ServerInfoUpdater) updateInfoPacks(storage *filesystem.Storage) error {
+	packs, err := dotgit.New(storage.Filesystem()).ObjectPacks()
+	if err != nil {
+		return fmt.Errorf("failed to list the packs: %w", err)
+	}
+
+	content := strings.Builder{}
+	for _, pack := range packs {
+		content.WriteString(fmt.Sprintf("P pack-%s.pack\n", pack))
+	}
+	content.WriteString("\n")
+
+	err = writeInfoFile(storage, "objects/info/packs", content.String())
+	if err != nil {
+		return fmt.Errorf("failed to write the \"objects/info/packs\" file: %w", err)
+	}
+
+	return nil
+}
+
+// ParseInfoRefs parses an "info/refs" file written by UpdateServerInfo. The
+// peeled tags are ignored.
+func ParseInfoRefs(r io.Reader) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	res := map[plumbing.ReferenceName]plumbing.Hash{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		rawHash, name, ok := strings.Cut(line, "\t")
+		if !ok || !plumbing.IsHash(rawHash) {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+
+		if strings.HasSuffix(name, "^{}") {
+			continue
+		}
+
+		res[plumbing.ReferenceName(name)] = plumbing.NewHash(rawHash)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the refs: %w", err)
+	}
+
+	return res, nil
+}
+
+// peelTag returns the first non-tag object pointed by hash.
+func peelTag(storage *filesystem.Storage, hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := storage.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to retrieve the object %q: %w", hash, err)
+		}
+
+		if obj.Type() != plumbing.TagObject {
+			return hash, nil
+		}
+
+		tag, err := object.DecodeTag(storage, obj)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to decode the tag %q: %w", hash, err)
+		}
+
+		hash = tag.Target
+	}
+}
+
+func writeInfoFile(storage *filesystem.Storage, filePath string, content string) error {
+	fs := storage.Filesystem()
+
+	err := fs.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create the parent folder: %w", err)
+	}
+
+	file, err := fs.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create the file: %w", err)
+	}
+
+	_, err = io.WriteString(file, content)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write the file: %w", err)
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,148 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+)
+
+// tagCommit creates an annotated tag pointing to target.
+func tagCommit(t *testing.T, storage *filesystem.Storage, name string, target plumbing.Hash) plumbing.Hash {
+	t.Helper()
+
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1649116800, 0)},
+		Message:    "release " + name,
+		TargetType: plumbing.CommitObject,
+		Target:     target,
+	}
+
+	obj := storage.NewEncodedObject()
+	err := tag.Encode(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := storage.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.SetReference(plumbing.NewHashReference(plumbing.NewTagReferenceName(name), hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+func TestServerInfoUpdaterUpdateServerInfo(t *testing.T) {
+	dir := t.TempDir()
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+
+	first := commitFile(t, storage, plumbing.ZeroHash, "first")
+	second := commitFile(t, storage, first, "second")
+
+	refs := map[plumbing.ReferenceName]plumbing.Hash{
+		plumbing.Master:                        second,
+		plumbing.NewBranchReferenceName("dev"): first,
+		plumbing.NewTagReferenceName("light"):  first,
+	}
+	for name, hash := range refs {
+		err := storage.SetReference(plumbing.NewHashReference(name, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	annotated := tagCommit(t, storage, "v1.0.0", first)
+	refs[plumbing.NewTagReferenceName("v1.0.0")] = annotated
+
+	err := storage.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pack the first commit objects, the others stay loose.
+	err = encodePack(storage, dotgit.New(storage.Filesystem()), []plumbing.Hash{first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Reindex()
+
+	packs, err := dotgit.New(storage.Filesystem()).ObjectPacks()
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("expected a pack, got %v, %v", packs, err)
+	}
+
+	err = NewServerInfoUpdater().UpdateServerInfo(context.Background(), storage)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rawRefs, err := os.ReadFile(filepath.Join(dir, "info", "refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The refs are sorted, the annotated tag is followed by its peeled
+	// commit and HEAD is not listed.
+	expected := strings.Join([]string{
+		first.String() + "\trefs/heads/dev",
+		second.String() + "\trefs/heads/master",
+		first.String() + "\trefs/tags/light",
+		annotated.String() + "\trefs/tags/v1.0.0",
+		first.String() + "\trefs/tags/v1.0.0^{}",
+	}, "\n") + "\n"
+	if string(rawRefs) != expected {
+		t.Errorf("expected the info/refs:\n%s\ngot:\n%s", expected, rawRefs)
+	}
+
+	parsed, err := ParseInfoRefs(bytes.NewReader(rawRefs))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(parsed, refs) {
+		t.Errorf("expected %v, got %v", refs, parsed)
+	}
+
+	head, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil || string(head) != "ref: refs/heads/master\n" {
+		t.Errorf("expected the HEAD to point to master, got %q, %v", head, err)
+	}
+
+	rawPacks, err := os.ReadFile(filepath.Join(dir, "objects", "info", "packs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "P pack-" + packs[0].String() + ".pack\n\n"; string(rawPacks) != expected {
+		t.Errorf("expected the objects/info/packs %q, got %q", expected, rawPacks)
+	}
+}
+
+func TestParseInfoRefs(t *testing.T) {
+	_, err := ParseInfoRefs(strings.NewReader("not a hash\trefs/heads/master\n"))
+	if err == nil {
+		t.Errorf("expected an invalid line to be rejected")
+	}
+
+	_, err = ParseInfoRefs(strings.NewReader(plumbing.ZeroHash.String() + " refs/heads/master\n"))
+	if err == nil {
+		t.Errorf("expected a line without tab to be rejected")
+	}
+}
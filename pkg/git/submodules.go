@@ -0,0 +1,173 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const gitmodulesFile = ".gitmodules"
+
+// SubmoduleScanner lists the repositories referenced as submodules by a
+// repository.
+type SubmoduleScanner struct {
+}
+
+func NewSubmoduleScanner() *SubmoduleScanner {
+	return &SubmoduleScanner{}
+}
+
+// Scan parses the .gitmodules file at the tip of every reference and returns
+// the sorted list of the submodule urls. The relative urls are resolved
+// against repoURL, as git does.
+//
+// An unparsable .gitmodules is logged and ignored, it doesn't break the
+// checkout of the mirror more than it breaks the upstream one.
+func (s *SubmoduleScanner) Scan(storage *filesystem.Storage, repoURL string) ([]string, error) {
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an iterator on references: %w", err)
+	}
+
+	urls := map[string]struct{}{}
+	seen := map[plumbing.Hash]struct{}{}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		target, err := peelTag(storage, ref.Hash())
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", ref.Name(), err)
+		}
+
+		commit, err := object.GetCommit(storage, target)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			// Not a commit, ex: a tag on a blob.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the commit of %s: %w", ref.Name(), err)
+		}
+
+		tree, err := commit.Tree()
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the tree of %s: %w", ref.Name(), err)
+		}
+
+		file, err := tree.File(gitmodulesFile)
+		if errors.Is(err, object.ErrFileNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the %s file of %s: %w", gitmodulesFile, ref.Name(), err)
+		}
+
+		// Most of the references share the same .gitmodules.
+		if _, ok := seen[file.Hash]; ok {
+			return nil
+		}
+		seen[file.Hash] = struct{}{}
+
+		content, err := file.Contents()
+		if err != nil {
+			return fmt.Errorf("failed to read the %s file of %s: %w", gitmodulesFile, ref.Name(), err)
+		}
+
+		modules := config.NewModules()
+		err = modules.Unmarshal([]byte(content))
+		if err != nil {
+			log.Printf("invalid %s file in %s, ignore it: %s", gitmodulesFile, ref.Name(), err)
+			return nil
+		}
+
+		for _, module := range modules.Submodules {
+			if module.URL == "" {
+				continue
+			}
+
+			u, err := resolveSubmoduleURL(repoURL, module.URL)
+			if err != nil {
+				log.Printf("invalid url for the submodule %q in %s, ignore it: %s", module.Name, ref.Name(), err)
+				continue
+			}
+
+			urls[u] = struct{}{}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(urls))
+	for u := range urls {
+		res = append(res, u)
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+// resolveSubmoduleURL resolves the "./" and "../" urls relatively to the
+// parent repository url.
+func resolveSubmoduleURL(parentURL string, rawURL string) (string, error) {
+	if !strings.HasPrefix(rawURL, "./") && !strings.HasPrefix(rawURL, "../") {
+		return rawURL, nil
+	}
+
+	u, err := url.Parse(parentURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the parent url %q: %w", parentURL, err)
+	}
+
+	u.Path = path.Join(u.Path, rawURL)
+
+	return u.String(), nil
+}
+
+// SubmoduleCloneURL returns the https url used to mirror a submodule. The ssh
+// and git urls are converted as the mirrored repositories are fetched over
+// https. Only the port of the http urls is kept, the other ones belong to
+// an other protocol.
+func SubmoduleCloneURL(rawURL string) (string, error) {
+	ep, err := transport.NewEndpoint(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url: %w", err)
+	}
+
+	switch ep.Protocol {
+	case "http", "https", "ssh", "git":
+	default:
+		return "", fmt.Errorf("unsupported protocol %q", ep.Protocol)
+	}
+
+	if ep.Host == "" {
+		return "", fmt.Errorf("invalid url %q: no host", rawURL)
+	}
+
+	host := ep.Host
+	if (ep.Protocol == "http" || ep.Protocol == "https") && ep.Port != 0 {
+		host = fmt.Sprintf("%s:%d", ep.Host, ep.Port)
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   host,
+		Path:   "/" + strings.TrimPrefix(ep.Path, "/"),
+	}
+
+	return u.String(), nil
+}
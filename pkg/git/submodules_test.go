@@ -0,0 +1,73 @@
+package git
+
+import "testing"
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		parentURL string
+		rawURL    string
+		expected  string
+	}{
+		{"sibling", "https://github.com/owner/repo", "../other.git", "https://github.com/owner/other.git"},
+		{"sibling of a .git url", "https://github.com/owner/repo.git", "../other", "https://github.com/owner/other"},
+		{"other owner", "https://github.com/owner/repo", "../../other/lib.git", "https://github.com/other/lib.git"},
+		{"child", "https://github.com/owner/repo", "./sub", "https://github.com/owner/repo/sub"},
+		{"absolute", "https://github.com/owner/repo", "https://gitlab.com/owner/lib.git", "https://gitlab.com/owner/lib.git"},
+		{"scp", "https://github.com/owner/repo", "git@github.com:owner/lib", "git@github.com:owner/lib"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := resolveSubmoduleURL(test.parentURL, test.rawURL)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if res != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, res)
+			}
+		})
+	}
+}
+
+func TestSubmoduleCloneURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawURL   string
+		expected string
+		err      bool
+	}{
+		{name: "https", rawURL: "https://github.com/owner/repo.git", expected: "https://github.com/owner/repo.git"},
+		{name: "http", rawURL: "http://github.com/owner/repo", expected: "https://github.com/owner/repo"},
+		{name: "scp", rawURL: "git@github.com:owner/repo", expected: "https://github.com/owner/repo"},
+		{name: "scp with slash", rawURL: "git@github.com:/owner/repo.git", expected: "https://github.com/owner/repo.git"},
+		{name: "ssh", rawURL: "ssh://git@gitlab.com:2222/owner/repo.git", expected: "https://gitlab.com/owner/repo.git"},
+		{name: "git", rawURL: "git://git.kernel.org/pub/scm/git/git.git", expected: "https://git.kernel.org/pub/scm/git/git.git"},
+		{name: "https with port", rawURL: "https://git.example.org:8443/owner/repo", expected: "https://git.example.org:8443/owner/repo"},
+		{name: "non GitHub host", rawURL: "https://gitlab.com/group/sub/repo.git", expected: "https://gitlab.com/group/sub/repo.git"},
+		{name: "local path", rawURL: "/srv/git/repo.git", err: true},
+		{name: "unresolved relative", rawURL: "../repo.git", err: true},
+		{name: "file", rawURL: "file:///srv/git/repo.git", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := SubmoduleCloneURL(test.rawURL)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %q", res)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if res != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, res)
+			}
+		})
+	}
+}
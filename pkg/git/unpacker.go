@@ -1,9 +1,10 @@
 package git
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path"
 	"time"
@@ -13,18 +14,31 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
 	"github.com/go-git/go-git/v5/plumbing/format/objfile"
 	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
 )
 
+// Unpacker explodes the packfiles into loose objects or keeps them
+// depending on the selected Layout.
+//
+// The non-deltified objects are streamed from the packfile to the loose
+// object file. The deltified objects need their base to be resolved in
+// memory, git doesn't deltify the objects bigger than core.bigFileThreshold
+// (512MiB by default) so this bounds the memory used.
 type Unpacker struct {
+	opts UnpackOptions
 }
 
-func NewUnpacker() *Unpacker {
-	return &Unpacker{}
+func NewUnpacker(opts UnpackOptions) *Unpacker {
+	return &Unpacker{opts}
 }
 
-func (u *Unpacker) Unpack(storage billy.Filesystem) error {
-	dir := dotgit.New(storage)
+// Unpack applies the layout to every pack of the repository. A cancelled
+// context stops it between two objects, the repository must then be
+// discarded.
+func (u *Unpacker) Unpack(ctx context.Context, storage *filesystem.Storage) error {
+	fs := storage.Filesystem()
+	dir := dotgit.New(fs)
 
 	packsHashs, err := dir.ObjectPacks()
 	if err != nil {
@@ -32,102 +46,238 @@ func (u *Unpacker) Unpack(storage billy.Filesystem) error {
 	}
 
 	for _, packHash := range packsHashs {
-		packFil, err := dir.ObjectPack(packHash)
+		packStat, err := fs.Stat(packPath(packHash))
 		if err != nil {
-			return fmt.Errorf("failed to retrieve the packfile %q: %w", packHash, err)
+			return fmt.Errorf("failed to stat the pack %q: %w", packHash, err)
 		}
 
-		idxFile, err := dir.ObjectPackIdx(packHash)
-		if err != nil {
-			return fmt.Errorf("failed to retrieve the idx file for pack %q: %w", packHash, err)
-		}
+		keep := u.opts.Layout == LayoutPacked ||
+			(u.opts.Layout == LayoutHybrid && packStat.Size() >= u.opts.HybridThreshold)
 
-		idx := idxfile.NewMemoryIndex()
-		err = idxfile.NewDecoder(idxFile).Decode(idx)
-		if err != nil {
-			return fmt.Errorf("failed to decode the idx file for pack %q: %w", packHash, err)
+		switch {
+		case keep && (u.opts.MaxPackSize <= 0 || packStat.Size() <= u.opts.MaxPackSize):
+			continue
+		case keep:
+			err = splitPack(ctx, storage, dir, packHash, u.opts.MaxPackSize)
+			if err != nil {
+				return fmt.Errorf("failed to split the pack %q: %w", packHash, err)
+			}
+		default:
+			err = u.unpackPack(ctx, fs, dir, packHash)
+			if err != nil {
+				return err
+			}
 		}
 
-		pack := packfile.NewPackfile(idx, nil, packFil)
-		objs, err := pack.GetAll()
+		err = dir.DeleteOldObjectPackAndIndex(packHash, time.Time{})
 		if err != nil {
-			return fmt.Errorf("failed to fetch all objects from pack %q: %w", packHash, err)
+			return fmt.Errorf("failed to delete the packfile %q and the corresponding index: %w", packHash, err)
 		}
+	}
 
-		err = objs.ForEach(func(obj plumbing.EncodedObject) error {
-			file, err := u.createObjectFileForHash(storage, obj.Hash())
-			if err != nil {
-				return err
-			}
+	// The storage keeps a list of the packs which is now outdated.
+	storage.Reindex()
 
-			writer := objfile.NewWriter(file)
-			writer.WriteHeader(obj.Type(), obj.Size())
+	return nil
+}
 
-			objReader, err := obj.Reader()
-			if err != nil {
-				return fmt.Errorf("failed to retrieve writer for object %q: %w", obj.Hash(), err)
-			}
+func (u *Unpacker) unpackPack(ctx context.Context, storage billy.Filesystem, dir *dotgit.DotGit, packHash plumbing.Hash) error {
+	idxFile, err := dir.ObjectPackIdx(packHash)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the idx file for pack %q: %w", packHash, err)
+	}
+	defer func() { _ = idxFile.Close() }()
 
-			buf, err := ioutil.ReadAll(objReader)
-			if err != nil {
-				return fmt.Errorf("failed to write the object %q inside a buffer: %w", obj.Hash(), err)
-			}
+	idx := idxfile.NewMemoryIndex()
+	err = idxfile.NewDecoder(idxFile).Decode(idx)
+	if err != nil {
+		return fmt.Errorf("failed to decode the idx file for pack %q: %w", packHash, err)
+	}
 
-			err = objReader.Close()
-			if err != nil {
-				return fmt.Errorf("failed to close the object: %w", err)
-			}
+	// The scanner streams the regular objects while the packfile resolves
+	// the deltas. They both need their own file cursor.
+	scanFile, err := dir.ObjectPack(packHash)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the packfile %q: %w", packHash, err)
+	}
+	defer func() { _ = scanFile.Close() }()
 
-			if int64(len(buf)) != obj.Size() {
-				return fmt.Errorf("the buffer is not completly full after receiving the data from object %q (%d != %d)", obj.Hash(), len(buf), obj.Size())
-			}
+	packFile, err := dir.ObjectPack(packHash)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the packfile %q: %w", packHash, err)
+	}
+	defer func() { _ = packFile.Close() }()
 
-			writer.Write(buf)
-			err = writer.Close()
-			if err != nil {
-				return fmt.Errorf("failed to close the object writer: %w", err)
-			}
+	scanner := packfile.NewScanner(scanFile)
+	pack := packfile.NewPackfile(idx, nil, packFile)
+
+	entries, err := idx.EntriesByOffset()
+	if err != nil {
+		return fmt.Errorf("failed to list the objects from pack %q: %w", packHash, err)
+	}
+	defer func() { _ = entries.Close() }()
 
-			return nil
-		})
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry, err := entries.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
 		if err != nil {
-			return fmt.Errorf("failed to unpack the objects: %w", err)
+			return fmt.Errorf("failed to list the objects from pack %q: %w", packHash, err)
 		}
 
-		err = dir.DeleteOldObjectPackAndIndex(packHash, time.Time{})
+		exists, err := u.objectFileExists(storage, entry.Hash)
 		if err != nil {
-			return fmt.Errorf("failed to delete the packfile %q and the corresponding index: %w", packHash, err)
+			return err
+		}
+
+		if exists {
+			continue
+		}
+
+		header, err := scanner.SeekObjectHeader(int64(entry.Offset))
+		if err != nil {
+			return fmt.Errorf("failed to read the header of object %q: %w", entry.Hash, err)
+		}
+
+		switch header.Type {
+		case plumbing.CommitObject, plumbing.TreeObject, plumbing.BlobObject, plumbing.TagObject:
+			err = u.writeObjectFile(storage, entry.Hash, header.Type, header.Length, func(w io.Writer) error {
+				_, _, err := scanner.NextObject(w)
+				return err
+			})
+		default:
+			var obj plumbing.EncodedObject
+			obj, err = pack.GetByOffset(int64(entry.Offset))
+			if err != nil {
+				return fmt.Errorf("failed to resolve the delta object %q: %w", entry.Hash, err)
+			}
+
+			err = u.writeObjectFile(storage, entry.Hash, obj.Type(), obj.Size(), func(w io.Writer) error {
+				objReader, err := obj.Reader()
+				if err != nil {
+					return fmt.Errorf("failed to retrieve the reader: %w", err)
+				}
+				defer func() { _ = objReader.Close() }()
+
+				_, err = io.Copy(w, objReader)
+				return err
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unpack the object %q from pack %q: %w", entry.Hash, packHash, err)
 		}
 	}
 
 	return nil
 }
 
-func (u *Unpacker) createObjectFileForHash(fs billy.Filesystem, hash plumbing.Hash) (billy.File, error) {
+// writeObjectFile writes a loose object with the content provided by the
+// write function. The object is written into a temporary file and only
+// moved to its final location once its hash has been verified.
+func (u *Unpacker) writeObjectFile(
+	fs billy.Filesystem,
+	hash plumbing.Hash,
+	typ plumbing.ObjectType,
+	size int64,
+	write func(w io.Writer) error,
+) error {
+	tmpFile, err := fs.TempFile("objects", "tmp_obj_")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+
+	err = u.encodeObject(tmpFile, hash, typ, size, write)
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = fs.Remove(tmpFile.Name())
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		_ = fs.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to close the temporary file: %w", err)
+	}
+
 	prefix := hash.String()[0:2]
 	fileName := hash.String()[2:]
 
-	err := fs.MkdirAll(path.Join("objects/", prefix), 0755)
+	err = fs.MkdirAll(path.Join("objects", prefix), 0755)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create the dir for hash %q: %w", hash, err)
+		return fmt.Errorf("failed to create the dir for hash %q: %w", hash, err)
 	}
 
-	filePath := path.Join("objects/", prefix, fileName)
+	err = fs.Rename(tmpFile.Name(), path.Join("objects", prefix, fileName))
+	if err != nil {
+		_ = fs.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to move the object file: %w", err)
+	}
 
-	_, err = fs.Stat(filePath)
-	if errors.Is(err, os.ErrNotExist) {
-		file, err := fs.Create(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create the file for object %q: %w", hash, err)
-		}
+	return nil
+}
 
-		return file, nil
+func (u *Unpacker) encodeObject(
+	file io.Writer,
+	hash plumbing.Hash,
+	typ plumbing.ObjectType,
+	size int64,
+	write func(w io.Writer) error,
+) error {
+	writer := objfile.NewWriter(file)
+
+	err := writer.WriteHeader(typ, size)
+	if err != nil {
+		return fmt.Errorf("failed to write the header: %w", err)
+	}
+
+	counter := &countingWriter{w: writer}
+
+	err = write(counter)
+	if err != nil {
+		return fmt.Errorf("failed to write the content: %w", err)
 	}
 
-	file, err := fs.Open(filePath)
+	err = writer.Close()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open the file for object %q: %w", hash, err)
+		return fmt.Errorf("failed to close the object writer: %w", err)
 	}
 
-	return file, nil
+	if counter.n != size {
+		return fmt.Errorf("invalid object size (%d != %d)", counter.n, size)
+	}
+
+	if writer.Hash() != hash {
+		return fmt.Errorf("invalid object hash: got %q", writer.Hash())
+	}
+
+	return nil
+}
+
+func (u *Unpacker) objectFileExists(fs billy.Filesystem, hash plumbing.Hash) (bool, error) {
+	_, err := fs.Stat(path.Join("objects", hash.String()[0:2], hash.String()[2:]))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat the object %q: %w", hash, err)
+	}
+
+	return true, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
 }
@@ -0,0 +1,209 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+)
+
+func readObject(t *testing.T, obj plumbing.EncodedObject) []byte {
+	t.Helper()
+
+	r, err := obj.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func looseObjectPath(hash plumbing.Hash) string {
+	return path.Join("objects", hash.String()[0:2], hash.String()[2:])
+}
+
+func TestUnpackerUnpack(t *testing.T) {
+	fixture := newLayoutFixture(t, 30)
+	all := append(append([]plumbing.Hash{}, fixture.v1...), fixture.v2...)
+
+	tests := []struct {
+		name   string
+		opts   UnpackOptions
+		loose  bool
+		nbPack func(n int) bool
+	}{
+		{name: "loose", opts: UnpackOptions{Layout: LayoutLoose}, loose: true, nbPack: func(n int) bool { return n == 0 }},
+		{name: "packed", opts: UnpackOptions{Layout: LayoutPacked}, nbPack: func(n int) bool { return n == 1 }},
+		{name: "packed-split", opts: UnpackOptions{Layout: LayoutPacked, MaxPackSize: 16 * 1024}, nbPack: func(n int) bool { return n > 1 }},
+		{name: "hybrid-small", opts: UnpackOptions{Layout: LayoutHybrid, HybridThreshold: 1 << 30}, loose: true, nbPack: func(n int) bool { return n == 0 }},
+		{name: "hybrid-big", opts: UnpackOptions{Layout: LayoutHybrid, HybridThreshold: 1}, nbPack: func(n int) bool { return n == 1 }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+			// A single pack holding both versions, the modified files are
+			// deltified against their first version.
+			fixture.writePack(t, storage, all)
+
+			err := NewUnpacker(test.opts).Unpack(context.Background(), storage)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			packs, err := dotgit.New(storage.Filesystem()).ObjectPacks()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.nbPack(len(packs)) {
+				t.Errorf("unexpected number of packs: %d", len(packs))
+			}
+
+			for _, hash := range all {
+				expected, err := fixture.objects.EncodedObject(plumbing.AnyObject, hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				obj, err := storage.EncodedObject(plumbing.AnyObject, hash)
+				if err != nil {
+					t.Fatalf("object %s not found: %s", hash, err)
+				}
+
+				if obj.Type() != expected.Type() || !bytes.Equal(readObject(t, obj), readObject(t, expected)) {
+					t.Errorf("object %s differs", hash)
+				}
+
+				_, err = storage.Filesystem().Stat(looseObjectPath(hash))
+				if test.loose && err != nil {
+					t.Errorf("expected the loose object %s: %s", hash, err)
+				}
+				if !test.loose && err == nil {
+					t.Errorf("expected the object %s to stay packed", hash)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackerUnpackCorruptedPack(t *testing.T) {
+	fixture := newLayoutFixture(t, 30)
+
+	dir := t.TempDir()
+	fs := osfs.New(dir)
+	storage := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+	fixture.writePack(t, storage, fixture.v1)
+
+	packs, err := dotgit.New(fs).ObjectPacks()
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("expected a pack, got %v, %v", packs, err)
+	}
+
+	// Flip the bytes in the middle of the pack, inside the compressed data
+	// of some object.
+	content, err := os.ReadFile(filepath.Join(dir, packPath(packs[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := len(content) / 2; i < len(content)/2+16; i++ {
+		content[i] ^= 0xff
+	}
+
+	err = os.WriteFile(filepath.Join(dir, packPath(packs[0])), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewUnpacker(UnpackOptions{Layout: LayoutLoose}).Unpack(context.Background(), storage)
+	if err == nil {
+		t.Fatal("expected the corrupted pack to be rejected")
+	}
+
+	// The pack is kept for the next attempt.
+	if _, err := fs.Stat(packPath(packs[0])); err != nil {
+		t.Errorf("expected the pack to be kept: %s", err)
+	}
+}
+
+func TestUnpackerWriteObjectFile(t *testing.T) {
+	content := []byte("some file content\n")
+	hash := plumbing.ComputeHash(plumbing.BlobObject, content)
+
+	tests := []struct {
+		name    string
+		hash    plumbing.Hash
+		size    int64
+		content []byte
+		valid   bool
+	}{
+		{name: "valid", hash: hash, size: int64(len(content)), content: content, valid: true},
+		{name: "corrupted", hash: hash, size: int64(len(content)), content: []byte("some file CONTENT\n")},
+		{name: "truncated", hash: hash, size: int64(len(content)), content: content[:10]},
+		{name: "too long", hash: hash, size: int64(len(content)), content: append(append([]byte{}, content...), '!')},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := memfs.New()
+
+			err := NewUnpacker(UnpackOptions{}).writeObjectFile(fs, test.hash, plumbing.BlobObject, test.size, func(w io.Writer) error {
+				_, err := w.Write(test.content)
+				return err
+			})
+
+			if test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+
+			_, statErr := fs.Stat(looseObjectPath(test.hash))
+			if test.valid != (statErr == nil) {
+				t.Errorf("expected the object file to exist: %v, got %v", test.valid, statErr)
+			}
+
+			// No temporary file is left.
+			entries, err := fs.ReadDir("objects")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					t.Errorf("unexpected file %q", entry.Name())
+				}
+			}
+
+			if !test.valid {
+				return
+			}
+
+			storage := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+			obj, err := storage.EncodedObject(plumbing.BlobObject, test.hash)
+			if err != nil {
+				t.Fatalf("the object can't be read: %s", err)
+			}
+
+			if !bytes.Equal(readObject(t, obj), content) {
+				t.Errorf("invalid object content")
+			}
+		})
+	}
+}
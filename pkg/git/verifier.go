@@ -0,0 +1,199 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// maxReportedObjects is the maximum number of objects listed by
+// VerificationError.Error.
+const maxReportedObjects = 20
+
+// VerificationError reports all the problems found by the Verifier. The maps
+// associate each problematic object with the path used to reach it.
+type VerificationError struct {
+	Missing   map[plumbing.Hash]string
+	Corrupted map[plumbing.Hash]string
+}
+
+func (e *VerificationError) Error() string {
+	res := strings.Builder{}
+
+	res.WriteString(fmt.Sprintf("%d missing objects, %d corrupted objects", len(e.Missing), len(e.Corrupted)))
+
+	for _, list := range []struct {
+		name    string
+		objects map[plumbing.Hash]string
+	}{{"missing", e.Missing}, {"corrupted", e.Corrupted}} {
+		i := 0
+		for hash, from := range list.objects {
+			if i == maxReportedObjects {
+				res.WriteString(fmt.Sprintf("\n%s: ...", list.name))
+				break
+			}
+
+			res.WriteString(fmt.Sprintf("\n%s: %s (%s)", list.name, hash, from))
+			i++
+		}
+	}
+
+	return res.String()
+}
+
+// Verifier checks that a repository is complete before its publication.
+type Verifier struct {
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{}
+}
+
+type pendingObject struct {
+	hash plumbing.Hash
+	from string
+}
+
+// Verify walks the history of every reference and checks that all the
+// reachable objects are present and have a valid hash. It returns a
+// *VerificationError if the repository is broken.
+func (v *Verifier) Verify(ctx context.Context, storage *filesystem.Storage) error {
+	refs, err := storage.IterReferences()
+	if err != nil {
+		return fmt.Errorf("failed to create an iterator on references: %w", err)
+	}
+
+	stack := []pendingObject{}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			stack = append(stack, pendingObject{ref.Hash(), ref.Name().String()})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list the references: %w", err)
+	}
+
+	report := &VerificationError{
+		Missing:   map[plumbing.Hash]string{},
+		Corrupted: map[plumbing.Hash]string{},
+	}
+	visited := map[plumbing.Hash]struct{}{}
+
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if _, ok := visited[current.hash]; ok {
+			continue
+		}
+		visited[current.hash] = struct{}{}
+
+		obj, err := storage.EncodedObject(plumbing.AnyObject, current.hash)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			report.Missing[current.hash] = current.from
+			continue
+		}
+		if err != nil {
+			report.Corrupted[current.hash] = fmt.Sprintf("%s: %s", current.from, err)
+			continue
+		}
+
+		err = v.checkHash(obj, current.hash)
+		if err != nil {
+			report.Corrupted[current.hash] = fmt.Sprintf("%s: %s", current.from, err)
+			continue
+		}
+
+		children, err := v.children(storage, obj)
+		if err != nil {
+			report.Corrupted[current.hash] = fmt.Sprintf("%s: %s", current.from, err)
+			continue
+		}
+
+		stack = append(stack, children...)
+	}
+
+	if len(report.Missing) > 0 || len(report.Corrupted) > 0 {
+		return report
+	}
+
+	return nil
+}
+
+func (v *Verifier) checkHash(obj plumbing.EncodedObject, expected plumbing.Hash) error {
+	reader, err := obj.Reader()
+	if err != nil {
+		return fmt.Errorf("failed to read the object: %w", err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	hasher := plumbing.NewHasher(obj.Type(), obj.Size())
+
+	_, err = io.Copy(hasher, reader)
+	if err != nil {
+		return fmt.Errorf("failed to read the object: %w", err)
+	}
+
+	if hasher.Sum() != expected {
+		return fmt.Errorf("invalid hash %s", hasher.Sum())
+	}
+
+	return nil
+}
+
+// children returns the objects directly referenced by obj.
+func (v *Verifier) children(storage *filesystem.Storage, obj plumbing.EncodedObject) ([]pendingObject, error) {
+	res := []pendingObject{}
+
+	switch obj.Type() {
+	case plumbing.CommitObject:
+		commit, err := object.DecodeCommit(storage, obj)
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit: %w", err)
+		}
+
+		res = append(res, pendingObject{commit.TreeHash, fmt.Sprintf("tree of commit %s", commit.Hash)})
+		for _, parent := range commit.ParentHashes {
+			res = append(res, pendingObject{parent, fmt.Sprintf("parent of commit %s", commit.Hash)})
+		}
+
+	case plumbing.TreeObject:
+		tree, err := object.DecodeTree(storage, obj)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree: %w", err)
+		}
+
+		for _, entry := range tree.Entries {
+			// The submodules commits are in an other repository.
+			if entry.Mode == filemode.Submodule {
+				continue
+			}
+
+			res = append(res, pendingObject{entry.Hash, fmt.Sprintf("%q in tree %s", entry.Name, tree.Hash)})
+		}
+
+	case plumbing.TagObject:
+		tag, err := object.DecodeTag(storage, obj)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag: %w", err)
+		}
+
+		res = append(res, pendingObject{tag.Target, fmt.Sprintf("target of tag %s", tag.Hash)})
+	}
+
+	return res, nil
+}
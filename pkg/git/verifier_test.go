@@ -0,0 +1,101 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/objfile"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+func TestVerifierVerify(t *testing.T) {
+	dir := t.TempDir()
+	storage := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+
+	first := commitFile(t, storage, plumbing.ZeroHash, "first")
+	commitFile(t, storage, first, "second")
+
+	err := NewVerifier().Verify(context.Background(), storage)
+	if err != nil {
+		t.Fatalf("expected a clean repository to pass, got %s", err)
+	}
+
+	missing := plumbing.ComputeHash(plumbing.BlobObject, []byte("first"))
+	corrupted := plumbing.ComputeHash(plumbing.BlobObject, []byte("second"))
+
+	err = os.Remove(filepath.Join(dir, looseObjectPath(missing)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the content of the object by a valid object with an other
+	// hash.
+	objPath := filepath.Join(dir, looseObjectPath(corrupted))
+	err = os.Chmod(objPath, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(objPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := objfile.NewWriter(f)
+	err = w.WriteHeader(plumbing.BlobObject, int64(len("flipped")))
+	if err == nil {
+		_, err = w.Write([]byte("flipped"))
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a new storage to bypass the objects cache.
+	storage = filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+
+	err = NewVerifier().Verify(context.Background(), storage)
+
+	var report *VerificationError
+	if !errors.As(err, &report) {
+		t.Fatalf("expected a *VerificationError, got %v", err)
+	}
+
+	if len(report.Missing) != 1 || !strings.Contains(report.Missing[missing], "file.txt") {
+		t.Errorf("expected %s to be reported missing, got %v", missing, report.Missing)
+	}
+
+	if len(report.Corrupted) != 1 || !strings.Contains(report.Corrupted[corrupted], "invalid hash") {
+		t.Errorf("expected %s to be reported corrupted, got %v", corrupted, report.Corrupted)
+	}
+
+	if msg := report.Error(); !strings.HasPrefix(msg, "1 missing objects, 1 corrupted objects") ||
+		!strings.Contains(msg, missing.String()) || !strings.Contains(msg, corrupted.String()) {
+		t.Errorf("expected both objects in the report, got %q", msg)
+	}
+}
+
+func TestVerifierVerifyCanceled(t *testing.T) {
+	storage := newLocalStorage(t)
+	commitFile(t, storage, plumbing.ZeroHash, "content")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := NewVerifier().Verify(ctx, storage)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
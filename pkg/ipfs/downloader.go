@@ -0,0 +1,123 @@
+package ipfs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	cid "github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+// Downloader retrieves a repository previously uploaded by the Uploader.
+type Downloader struct {
+	shell *shell.Shell
+}
+
+func NewDownloader(shell *shell.Shell) *Downloader {
+	return &Downloader{shell}
+}
+
+// DownloadRepo writes the content of the directory repoCID into fs.
+func (d *Downloader) DownloadRepo(ctx context.Context, repoCID cid.Cid, fs billy.Filesystem) error {
+	resp, err := d.shell.Request("get", repoCID.String()).
+		Option("create", true).
+		Send(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the repo %q: %w", repoCID, err)
+	}
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	reader := tar.NewReader(resp.Output)
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the archive: %w", err)
+		}
+
+		// All the entries are inside a root directory named after the cid.
+		parts := strings.SplitN(path.Clean(header.Name), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		filePath := parts[1]
+
+		if strings.HasPrefix(filePath, "../") {
+			return fmt.Errorf("invalid path %q inside the archive", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = fs.MkdirAll(filePath, 0755)
+			if err != nil {
+				return fmt.Errorf("failed to create the directory %q: %w", filePath, err)
+			}
+		case tar.TypeReg:
+			err = writeFile(fs, filePath, reader)
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			err = fs.Symlink(header.Linkname, filePath)
+			if err != nil {
+				return fmt.Errorf("failed to create the symlink %q: %w", filePath, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadFile returns the content of a file inside a repository previously
+// uploaded.
+func (d *Downloader) ReadFile(ctx context.Context, repoCID cid.Cid, filePath string) ([]byte, error) {
+	resp, err := d.shell.Request("cat", path.Join("/ipfs", repoCID.String(), filePath)).Send(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cat %q: %w", filePath, err)
+	}
+	defer resp.Close()
+
+	if resp.Error != nil {
+		return nil, fmt.Errorf("failed to cat %q: %w", filePath, resp.Error)
+	}
+
+	content, err := io.ReadAll(resp.Output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", filePath, err)
+	}
+
+	return content, nil
+}
+
+func writeFile(fs billy.Filesystem, filePath string, content io.Reader) error {
+	file, err := fs.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create the file %q: %w", filePath, err)
+	}
+
+	_, err = io.Copy(file, content)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write the file %q: %w", filePath, err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the file %q: %w", filePath, err)
+	}
+
+	return nil
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
 	cid "github.com/ipfs/go-cid"
 	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
 	"github.com/ipld/go-ipld-prime/codec/dagjson"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/fluent/qp"
@@ -45,21 +47,31 @@ func NewIndexer(shell *shell.Shell, indexName string) (*Indexer, error) {
 	return &Indexer{shell, indexName, indexKeyID}, nil
 }
 
-func (i *Indexer) RetrieveIndex(ctx context.Context) (map[string]metadata.RepoMetadata, error) {
-	indexCID, err := i.shell.Resolve(i.indexKeyID)
+// RetrieveIndex returns the published index and its CID.
+func (i *Indexer) RetrieveIndex(ctx context.Context) (map[string]metadata.RepoMetadata, cid.Cid, error) {
+	indexPath, err := i.shell.Resolve(i.indexKeyID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve the index id: %w", err)
+		return nil, cid.Undef, fmt.Errorf("failed to resolve the index id: %w", err)
 	}
 
-	raw, err := i.shell.Cat(indexCID)
+	indexCID, err := cid.Decode(strings.TrimPrefix(indexPath, "/ipfs/"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve the raw index: %w", err)
+		return nil, cid.Undef, fmt.Errorf("invalid index path %q: %w", indexPath, err)
 	}
 
+	raw, err := i.shell.Cat(indexPath)
+	if err != nil {
+		return nil, cid.Undef, fmt.Errorf("failed to retrieve the raw index: %w", err)
+	}
+	defer raw.Close()
+
 	np := basicnode.Prototype.Any // Pick a stle for the in-memory data.
 	nb := np.NewBuilder()         // Create a builder.
-	dagjson.Decode(nb, raw)       // Hand the builder to decoding -- decoding will fill it in!
-	n := nb.Build()               // Call 'Build' to get the resulting Node.  (It's immutable!)
+	err = dagjson.Decode(nb, raw) // Hand the builder to decoding -- decoding will fill it in!
+	if err != nil {
+		return nil, cid.Undef, fmt.Errorf("failed to decode the index: %w", err)
+	}
+	n := nb.Build() // Call 'Build' to get the resulting Node.  (It's immutable!)
 
 	it := n.MapIterator()
 
@@ -70,91 +82,242 @@ func (i *Indexer) RetrieveIndex(ctx context.Context) (map[string]metadata.RepoMe
 			break
 		}
 
-		var meta metadata.RepoMetadata
-
 		mapKeyN, mapValueN, err := it.Next()
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode map: %w", err)
+			return nil, cid.Undef, fmt.Errorf("failed to decode map: %w", err)
 		}
 		metaKey, _ := mapKeyN.AsString()
 
-		it2 := mapValueN.MapIterator()
+		meta, err := decodeEntry(mapValueN)
+		if err != nil {
+			return nil, cid.Undef, fmt.Errorf("failed to decode the entry %q: %w", metaKey, err)
+		}
 
-		for {
-			if it2.Done() {
-				break
-			}
+		res[metaKey] = *meta
+	}
 
-			keyN, valueN, err := it2.Next()
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode map: %w", err)
-			}
-			key, _ := keyN.AsString()
-
-			switch key {
-			case "url":
-				meta.RepositoryURL, err = valueN.AsString()
-			case "rank":
-				var rank int64
-				rank, err = valueN.AsInt()
-				if err == nil {
-					meta.Rank = int(rank)
-				}
-			case "stars":
-				var nbStars int64
-				nbStars, err = valueN.AsInt()
-				if err == nil {
-					meta.NbStars = int(nbStars)
-				}
-			case "lastMetadataFetch":
-				rawDate, err := valueN.AsString()
-				if err == nil {
-					meta.LastMetadataFetch, err = time.Parse(time.RFC3339, rawDate)
-				}
-			case "repo":
-				var c datamodel.Link
-				c, err = valueN.AsLink()
-				if err == nil {
-					var repoCid cid.Cid
-					repoCid, err = cid.Parse(c.String())
-					meta.Repo = &repoCid
-				}
-			}
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse %q fields: %w", key, err)
-			}
+	return res, indexCID, nil
+}
+
+// decodeEntry decodes an index entry. The unknown fields are ignored and the
+// missing ones are left empty in order to decode the indexes generated by
+// the older versions.
+func decodeEntry(n datamodel.Node) (*metadata.RepoMetadata, error) {
+	var meta metadata.RepoMetadata
+
+	it := n.MapIterator()
+
+	for {
+		if it.Done() {
+			break
+		}
+
+		keyN, valueN, err := it.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode map: %w", err)
+		}
+		key, _ := keyN.AsString()
+
+		switch key {
+		case "url":
+			meta.RepositoryURL, err = valueN.AsString()
+		case "rank":
+			meta.Rank, err = decodeInt(valueN)
+		case "stars":
+			meta.NbStars, err = decodeInt(valueN)
+		case "forks":
+			meta.NbForks, err = decodeInt(valueN)
+		case "sizeKB":
+			meta.SizeKB, err = decodeInt(valueN)
+		case "description":
+			meta.Description, err = valueN.AsString()
+		case "language":
+			meta.Language, err = valueN.AsString()
+		case "license":
+			meta.License, err = valueN.AsString()
+		case "topics":
+			meta.Topics, err = decodeStringList(valueN)
+		case "defaultBranch":
+			meta.DefaultBranch, err = valueN.AsString()
+		case "archived":
+			meta.Archived, err = valueN.AsBool()
+		case "head":
+			meta.Head, err = valueN.AsString()
+		case "rankingUpdatedAt":
+			meta.RankingUpdatedAt, err = decodeTime(valueN)
+		case "lastMetadataFetch":
+			meta.LastMetadataFetch, err = decodeTime(valueN)
+		case "lastGitFetch":
+			meta.LastGitFetch, err = decodeTime(valueN)
+		case "repo":
+			meta.Repo, err = decodeCID(valueN)
+		case "lfs":
+			meta.LFS, err = decodeCID(valueN)
+		case "submodules":
+			meta.Submodules, err = decodeCIDMap(valueN)
+		case "bundles":
+			meta.Bundles, err = decodeCIDMap(valueN)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %q fields: %w", key, err)
+		}
+	}
+
+	return &meta, nil
+}
+
+func decodeInt(n datamodel.Node) (int, error) {
+	v, err := n.AsInt()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(v), nil
+}
+
+func decodeTime(n datamodel.Node) (time.Time, error) {
+	rawDate, err := n.AsString()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, rawDate)
+}
+
+func decodeCID(n datamodel.Node) (*cid.Cid, error) {
+	c, err := n.AsLink()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := cid.Parse(c.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// decodeCIDMap decodes a map of links, a null value gives a nil CID.
+func decodeCIDMap(n datamodel.Node) (map[string]*cid.Cid, error) {
+	res := map[string]*cid.Cid{}
+
+	it := n.MapIterator()
+	if it == nil {
+		return nil, fmt.Errorf("not a map")
+	}
+
+	for !it.Done() {
+		keyN, valueN, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := keyN.AsString()
+		if err != nil {
+			return nil, err
 		}
 
-		res[metaKey] = meta
+		if valueN.IsNull() {
+			res[key] = nil
+			continue
+		}
+
+		res[key], err = decodeCID(valueN)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return res, nil
 }
 
-func (i *Indexer) SaveIndex(ctx context.Context, index map[string]metadata.RepoMetadata) error {
+func decodeStringList(n datamodel.Node) ([]string, error) {
+	res := []string{}
+
+	it := n.ListIterator()
+	if it == nil {
+		return nil, fmt.Errorf("not a list")
+	}
+
+	for !it.Done() {
+		_, valueN, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := valueN.AsString()
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, value)
+	}
+
+	return res, nil
+}
+
+// SaveIndex pins and publishes a new version of the index and returns its
+// CID. The previous versions stay pinned, see UnpinIndex.
+//
+// If the version is pinned but its publication fails, its CID is returned
+// with the error so the caller can unpin it.
+func (i *Indexer) SaveIndex(ctx context.Context, index map[string]metadata.RepoMetadata) (cid.Cid, error) {
 	rawIndex := []byte{}
 	rawIndexBuf := bytes.NewBuffer(rawIndex)
 
 	err := i.EncodeIndex(index, rawIndexBuf)
 	if err != nil {
-		return fmt.Errorf("failed to encode the index: %w", err)
+		return cid.Undef, fmt.Errorf("failed to encode the index: %w", err)
 	}
 
-	indexCID, err := i.shell.Add(rawIndexBuf, shell.Pin(true))
+	body := files.NewMultiFileReader(files.NewSliceDirectory([]files.DirEntry{
+		files.FileEntry("", files.NewReaderFile(rawIndexBuf)),
+	}), true)
+
+	var added struct {
+		Hash string
+	}
+	err = i.shell.Request("add").
+		Option("pin", true).
+		Body(body).
+		Exec(ctx, &added)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to save the new index: %s", err)
+	}
+
+	indexCID, err := cid.Decode(added.Hash)
 	if err != nil {
-		return fmt.Errorf("failed to save the new index: %s", err)
+		return cid.Undef, fmt.Errorf("invalid CID for the new index: %w", err)
 	}
 
 	log.Println("start publishing the new index")
 	lifetime, _ := time.ParseDuration("2400H") // 100 days
 	ttl, _ := time.ParseDuration("1H")
 
-	_, err = i.shell.PublishWithDetails(indexCID, i.indexName, lifetime, ttl, true)
+	err = i.shell.Request("name/publish", indexCID.String()).
+		Option("key", i.indexName).
+		Option("lifetime", lifetime).
+		Option("ttl", ttl).
+		Option("resolve", true).
+		Exec(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to publish the new index: %w", err)
+		return indexCID, fmt.Errorf("failed to publish the new index: %w", err)
 	}
 	log.Println("new index successfully published")
 
+	return indexCID, nil
+}
+
+// UnpinIndex removes the pin of a version saved by SaveIndex.
+func (i *Indexer) UnpinIndex(ctx context.Context, indexCID cid.Cid) error {
+	err := i.shell.Request("pin/rm", indexCID.String()).
+		Option("recursive", true).
+		Exec(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to unpin the index %s: %w", indexCID, err)
+	}
+
 	return nil
 }
 
@@ -162,14 +325,8 @@ func (i *Indexer) EncodeIndex(index map[string]metadata.RepoMetadata, writer io.
 	n, err := qp.BuildMap(basicnode.Prototype.Any, int64(len(index)), func(ma datamodel.MapAssembler) {
 		for name, data := range index {
 			log.Printf("index: %s", name)
-			qp.MapEntry(ma, name, qp.Map(5, func(ma datamodel.MapAssembler) {
-				qp.MapEntry(ma, "url", qp.String(data.RepositoryURL))
-				qp.MapEntry(ma, "rank", qp.Int(int64(data.Rank)))
-				qp.MapEntry(ma, "stars", qp.Int(int64(data.NbStars)))
-				qp.MapEntry(ma, "lastMetadataFetch", qp.String(data.LastMetadataFetch.Format(time.RFC3339)))
-
-				lp := cidlink.Link{Cid: *data.Repo}
-				qp.MapEntry(ma, "repo", qp.Link(lp))
+			qp.MapEntry(ma, name, qp.Map(19, func(ma datamodel.MapAssembler) {
+				encodeEntry(ma, data)
 			}))
 		}
 	})
@@ -184,3 +341,61 @@ func (i *Indexer) EncodeIndex(index map[string]metadata.RepoMetadata, writer io.
 
 	return nil
 }
+
+func encodeEntry(ma datamodel.MapAssembler, data metadata.RepoMetadata) {
+	qp.MapEntry(ma, "url", qp.String(data.RepositoryURL))
+	qp.MapEntry(ma, "rank", qp.Int(int64(data.Rank)))
+	qp.MapEntry(ma, "stars", qp.Int(int64(data.NbStars)))
+	qp.MapEntry(ma, "forks", qp.Int(int64(data.NbForks)))
+	qp.MapEntry(ma, "sizeKB", qp.Int(int64(data.SizeKB)))
+	qp.MapEntry(ma, "description", qp.String(data.Description))
+	qp.MapEntry(ma, "language", qp.String(data.Language))
+	qp.MapEntry(ma, "license", qp.String(data.License))
+	qp.MapEntry(ma, "topics", qp.List(int64(len(data.Topics)), func(la datamodel.ListAssembler) {
+		for _, topic := range data.Topics {
+			qp.ListEntry(la, qp.String(topic))
+		}
+	}))
+	qp.MapEntry(ma, "defaultBranch", qp.String(data.DefaultBranch))
+	qp.MapEntry(ma, "archived", qp.Bool(data.Archived))
+	qp.MapEntry(ma, "head", qp.String(data.Head))
+	encodeTime(ma, "rankingUpdatedAt", data.RankingUpdatedAt)
+	encodeTime(ma, "lastMetadataFetch", data.LastMetadataFetch)
+	encodeTime(ma, "lastGitFetch", data.LastGitFetch)
+
+	if data.Repo != nil {
+		lp := cidlink.Link{Cid: *data.Repo}
+		qp.MapEntry(ma, "repo", qp.Link(lp))
+	}
+
+	if data.LFS != nil {
+		qp.MapEntry(ma, "lfs", qp.Link(cidlink.Link{Cid: *data.LFS}))
+	}
+
+	qp.MapEntry(ma, "submodules", encodeCIDMap(data.Submodules))
+	qp.MapEntry(ma, "bundles", encodeCIDMap(data.Bundles))
+}
+
+// encodeTime encodes a date with the RFC3339 format. The unknown dates are
+// omitted, ex: the ranking date of the sources without ranking updates.
+func encodeTime(ma datamodel.MapAssembler, key string, date time.Time) {
+	if date.IsZero() {
+		return
+	}
+
+	qp.MapEntry(ma, key, qp.String(date.Format(time.RFC3339)))
+}
+
+// encodeCIDMap encodes a map of links, a nil CID gives a null value.
+func encodeCIDMap(m map[string]*cid.Cid) qp.Assemble {
+	return qp.Map(int64(len(m)), func(ma datamodel.MapAssembler) {
+		for key, c := range m {
+			if c == nil {
+				qp.MapEntry(ma, key, qp.Null())
+				continue
+			}
+
+			qp.MapEntry(ma, key, qp.Link(cidlink.Link{Cid: *c}))
+		}
+	})
+}
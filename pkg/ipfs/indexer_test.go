@@ -0,0 +1,87 @@
+package ipfs
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/Peltoche/ipfs-gh1000/pkg/metadata"
+)
+
+func TestIndexerEncodeIndex(t *testing.T) {
+	fetchedAt := time.Date(2022, 4, 5, 2, 40, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		meta     metadata.RepoMetadata
+		excluded []string
+	}{
+		{
+			name: "all the dates",
+			meta: metadata.RepoMetadata{
+				RepositoryURL:     "https://github.com/freeCodeCamp/freeCodeCamp",
+				Rank:              1,
+				RankingUpdatedAt:  fetchedAt,
+				LastMetadataFetch: fetchedAt.Add(time.Hour),
+				LastGitFetch:      fetchedAt.Add(2 * time.Hour),
+			},
+		},
+		{
+			// The static source has no ranking date.
+			name: "unknown dates",
+			meta: metadata.RepoMetadata{
+				RepositoryURL:     "https://github.com/freeCodeCamp/freeCodeCamp",
+				Rank:              1,
+				LastMetadataFetch: fetchedAt,
+			},
+			excluded: []string{"rankingUpdatedAt", "lastGitFetch", "0001-01-01"},
+		},
+	}
+
+	for _, test := range tests {
+		// The empty collections are decoded as empty values.
+		test.meta.Topics = []string{}
+		test.meta.Submodules = map[string]*cid.Cid{}
+		test.meta.Bundles = map[string]*cid.Cid{}
+
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := (&Indexer{}).EncodeIndex(map[string]metadata.RepoMetadata{"freeCodeCamp/freeCodeCamp": test.meta}, &buf)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			for _, excluded := range test.excluded {
+				if strings.Contains(buf.String(), excluded) {
+					t.Errorf("expected %q to be omitted: %s", excluded, buf.String())
+				}
+			}
+
+			nb := basicnode.Prototype.Any.NewBuilder()
+			err = dagjson.Decode(nb, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entry, err := nb.Build().LookupByString("freeCodeCamp/freeCodeCamp")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			meta, err := decodeEntry(entry)
+			if err != nil {
+				t.Fatalf("failed to decode the entry: %s", err)
+			}
+
+			if !reflect.DeepEqual(*meta, test.meta) {
+				t.Errorf("expected %+v, got %+v", test.meta, *meta)
+			}
+		})
+	}
+}
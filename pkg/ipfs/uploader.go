@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"path"
+	"strings"
 
 	"github.com/go-git/go-billy/v5"
 	cid "github.com/ipfs/go-cid"
@@ -68,10 +70,74 @@ func (u *Uploader) UploadRepo(ctx context.Context, fs billy.Filesystem) (*cid.Ci
 	}
 
 	log.Printf("pin the repository: %s", final)
-	err = u.shell.Pin(final.String())
+	err = u.shell.Request("pin/add", final.String()).
+		Option("recursive", true).
+		Exec(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to pin the repo: %w", err)
 	}
 
 	return &final, nil
 }
+
+// Unpin removes the pin set by UploadRepo, it allows the node to garbage
+// collect a repository which will not be published.
+func (u *Uploader) Unpin(ctx context.Context, repo cid.Cid) error {
+	err := u.shell.Request("pin/rm", repo.String()).
+		Option("recursive", true).
+		Exec(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to unpin the repo: %w", err)
+	}
+
+	return nil
+}
+
+// ResolvePath returns the CID of the file or directory at the given path
+// inside an uploaded repository.
+func (u *Uploader) ResolvePath(ctx context.Context, repo cid.Cid, subPath string) (*cid.Cid, error) {
+	var out struct {
+		Path string
+	}
+
+	err := u.shell.Request("resolve", path.Join("/ipfs", repo.String(), subPath)).Exec(ctx, &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", subPath, err)
+	}
+
+	res, err := cid.Decode(strings.TrimPrefix(out.Path, "/ipfs/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID for %q: %w", subPath, err)
+	}
+
+	return &res, nil
+}
+
+// ListDir returns the CID of every entry of a directory inside an uploaded
+// repository.
+func (u *Uploader) ListDir(ctx context.Context, repo cid.Cid, subPath string) (map[string]*cid.Cid, error) {
+	var out struct {
+		Objects []shell.LsObject
+	}
+
+	err := u.shell.Request("ls", path.Join("/ipfs", repo.String(), subPath)).Exec(ctx, &out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %w", subPath, err)
+	}
+
+	if len(out.Objects) != 1 {
+		return nil, fmt.Errorf("failed to list %q: %d objects returned", subPath, len(out.Objects))
+	}
+
+	res := map[string]*cid.Cid{}
+	for _, link := range out.Objects[0].Links {
+		c, err := cid.Decode(link.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CID for %q: %w", link.Name, err)
+		}
+
+		res[link.Name] = &c
+	}
+
+	return res, nil
+}
@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/internal/fsutil"
+)
+
+// ErrNotCached is returned in offline mode when a page is not present
+// inside the cache.
+var ErrNotCached = errors.New("page not present in the cache")
+
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+}
+
+// Cache is an on-disk HTTP cache keyed by URL.
+//
+// Each page is saved as two files: "<key>.json" with the validators used for
+// the conditional requests and "<key>.body" with the page content.
+//
+// In offline mode the pages are only served from the cache and no request is
+// sent.
+type Cache struct {
+	dir     string
+	offline bool
+}
+
+func NewCache(dir string, offline bool) (*Cache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the cache dir %q: %w", dir, err)
+	}
+
+	return &Cache{dir, offline}, nil
+}
+
+// load returns the cached entry and body for the given url or a nil entry if
+// the url is not present in the cache.
+func (c *Cache) load(url string) (*cacheEntry, []byte, error) {
+	base := c.basePath(url)
+
+	rawEntry, err := os.ReadFile(base + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the cache entry for %q: %w", url, err)
+	}
+
+	var entry cacheEntry
+	err = json.Unmarshal(rawEntry, &entry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode the cache entry for %q: %w", url, err)
+	}
+
+	body, err := os.ReadFile(base + ".body")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the cached body for %q: %w", url, err)
+	}
+
+	return &entry, body, nil
+}
+
+func (c *Cache) store(entry *cacheEntry, body []byte) error {
+	base := c.basePath(entry.URL)
+
+	rawEntry, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode the cache entry for %q: %w", entry.URL, err)
+	}
+
+	// The body is written first so that an entry never points to a missing
+	// or partial body.
+	err = fsutil.WriteFileAtomic(base+".body", body)
+	if err != nil {
+		return fmt.Errorf("failed to write the cached body for %q: %w", entry.URL, err)
+	}
+
+	err = fsutil.WriteFileAtomic(base+".json", rawEntry)
+	if err != nil {
+		return fmt.Errorf("failed to write the cache entry for %q: %w", entry.URL, err)
+	}
+
+	return nil
+}
+
+func (c *Cache) basePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,145 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newCachedPageServer serves a page with the given validators and responds
+// "304 Not Modified" to the requests matching them. The conditional headers
+// of each request are recorded.
+func newCachedPageServer(t *testing.T, etag, lastModified string) (*httptest.Server, *[]http.Header) {
+	t.Helper()
+
+	requests := []http.Header{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, http.Header{
+			"If-None-Match":     r.Header.Values("If-None-Match"),
+			"If-Modified-Since": r.Header.Values("If-Modified-Since"),
+		})
+
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if lastModified != "" {
+			w.Header().Set("Last-Modified", lastModified)
+		}
+
+		if (etag != "" && r.Header.Get("If-None-Match") == etag) ||
+			(lastModified != "" && r.Header.Get("If-Modified-Since") == lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		_, _ = w.Write([]byte("page content"))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	const lastModified = "Tue, 05 Apr 2022 11:40:00 GMT"
+
+	tests := []struct {
+		name         string
+		etag         string
+		lastModified string
+		expected     http.Header // the conditional headers of the second request
+	}{
+		{
+			name:     "etag",
+			etag:     `"v1"`,
+			expected: http.Header{"If-None-Match": {`"v1"`}},
+		},
+		{
+			name:         "last modified",
+			lastModified: lastModified,
+			expected:     http.Header{"If-Modified-Since": {lastModified}},
+		},
+		{
+			name:     "no validator",
+			expected: http.Header{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, requests := newCachedPageServer(t, test.etag, test.lastModified)
+
+			cache, err := NewCache(t.TempDir(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := newTestClient(cache, 0)
+
+			for i := 0; i < 2; i++ {
+				body, err := client.Get(context.Background(), srv.URL, nil)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				// The second response is served from the disk.
+				if string(body) != "page content" {
+					t.Errorf("request %d: invalid body %q", i, body)
+				}
+			}
+
+			if len(*requests) != 2 {
+				t.Fatalf("expected 2 requests, got %d", len(*requests))
+			}
+
+			if first := (*requests)[0]; first.Get("If-None-Match") != "" || first.Get("If-Modified-Since") != "" {
+				t.Errorf("expected no conditional header on the first request, got %v", first)
+			}
+
+			second := (*requests)[1]
+			for _, key := range []string{"If-None-Match", "If-Modified-Since"} {
+				if second.Get(key) != test.expected.Get(key) {
+					t.Errorf("expected %s %q, got %q", key, test.expected.Get(key), second.Get(key))
+				}
+			}
+		})
+	}
+}
+
+func TestCacheOffline(t *testing.T) {
+	srv, requests := newCachedPageServer(t, `"v1"`, "")
+	dir := t.TempDir()
+
+	cache, err := NewCache(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newTestClient(cache, 0).Get(context.Background(), srv.URL+"/cached", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	offline, err := NewCache(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(offline, 0)
+
+	body, err := client.Get(context.Background(), srv.URL+"/cached", nil)
+	if err != nil || string(body) != "page content" {
+		t.Errorf("expected the cached page, got %q, %v", body, err)
+	}
+
+	_, err = client.Get(context.Background(), srv.URL+"/unknown", nil)
+	if !errors.Is(err, ErrNotCached) {
+		t.Errorf("expected ErrNotCached, got %v", err)
+	}
+
+	// No request is sent in offline mode.
+	if len(*requests) != 1 {
+		t.Errorf("expected 1 request, got %d", len(*requests))
+	}
+}
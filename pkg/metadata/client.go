@@ -0,0 +1,233 @@
+package metadata
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 2 * time.Minute
+	// maxRetryAfter caps the delay requested by the "Retry-After" header.
+	maxRetryAfter = 5 * time.Minute
+)
+
+// StatusError is returned by the Client when the server responds with an
+// unexpected status.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid status for %q: %s", e.URL, e.Status)
+}
+
+// Client is the HTTP client shared by all the metadata sources.
+//
+// All the requests are rate limited with a token bucket and the requests
+// failing with a network error, a timeout, a 429 or a 5xx status are retried
+// with an exponential backoff, honoring the "Retry-After" header if present
+// up to maxRetryAfter.
+//
+// If a cache is provided, the pages are saved inside it and revalidated with
+// conditional requests.
+type Client struct {
+	cache   *Cache
+	client  *http.Client
+	limiter *rateLimiter
+	retry   RetryPolicy
+}
+
+// NewClient creates a new Client.
+//
+// rate is the maximum number of requests per second (0 means unlimited) and
+// burst the number of requests which can be sent at once. The cache is
+// optional.
+func NewClient(cache *Cache, timeout time.Duration, maxRetries int, rate float64, burst int) *Client {
+	return &Client{
+		cache:   cache,
+		client:  &http.Client{Timeout: timeout},
+		limiter: newRateLimiter(rate, burst),
+		retry:   NewRetryPolicy(maxRetries),
+	}
+}
+
+// Get retrieves the body of the given url.
+func (c *Client) Get(ctx context.Context, url string, header http.Header) ([]byte, error) {
+	var (
+		cached     *cacheEntry
+		cachedBody []byte
+		err        error
+	)
+
+	if c.cache != nil {
+		cached, cachedBody, err = c.cache.load(url)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.cache.offline {
+			if cached == nil {
+				return nil, fmt.Errorf("failed to get %q: %w", url, ErrNotCached)
+			}
+
+			return cachedBody, nil
+		}
+	}
+
+	var body []byte
+	err = c.retry.Do(ctx, fmt.Sprintf("request to %q", url), func() (time.Duration, error) {
+		var (
+			retryAfter time.Duration
+			err        error
+		)
+		body, retryAfter, err = c.get(ctx, url, header, cached)
+		return retryAfter, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if body == nil {
+		// Not modified
+		return cachedBody, nil
+	}
+
+	return body, nil
+}
+
+// get sends a single request. If the cached entry is still valid it returns a
+// nil body.
+func (c *Client) get(ctx context.Context, url string, header http.Header, cached *cacheEntry) ([]byte, time.Duration, error) {
+	err := c.limiter.Wait(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create the request: %w", err)
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get the page: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if cached != nil && res.StatusCode == http.StatusNotModified {
+		return nil, 0, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, parseRetryAfter(res.Header.Get("Retry-After")), &StatusError{
+			URL:        url,
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+		}
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read the body: %w", err)
+	}
+
+	if c.cache != nil {
+		err = c.cache.store(&cacheEntry{
+			URL:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			FetchedAt:    time.Now(),
+		}, body)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return body, 0, nil
+}
+
+// isRetryable returns true for the transient errors: the 429 and 5xx
+// statuses, the timeouts and the network errors. The invalid requests, the
+// certificate errors and the cancellations are final.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certificateErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+	)
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certificateErr) || errors.As(err, &hostnameErr) {
+		return false
+	}
+
+	// The connection was closed while reading the response.
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+
+	// An unknown host is final, the DNS errors are wrapped into the dial
+	// errors so they must be checked first.
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+
+	// The dial and connection errors (refused, reset).
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// parseRetryAfter parses the "Retry-After" header value which is either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
@@ -0,0 +1,173 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client retrying quickly, without rate limit.
+func newTestClient(cache *Cache, maxRetries int) *Client {
+	client := NewClient(cache, 5*time.Second, maxRetries, 0, 1)
+	client.retry.MinBackoff = 10 * time.Millisecond
+
+	return client
+}
+
+// newStatusServer responds with the given statuses then with "ok". The
+// headers are set on every response.
+func newStatusServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *int) {
+	t.Helper()
+
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+
+		if hits <= len(statuses) {
+			w.WriteHeader(statuses[hits-1])
+			return
+		}
+
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &hits
+}
+
+func TestClientGetRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries int
+		hits       int
+		status     int // the status of the returned error, 0 for a success
+	}{
+		{name: "success", hits: 1},
+		{name: "5xx then success", statuses: []int{503, 500}, maxRetries: 2, hits: 3},
+		{name: "too many 5xx", statuses: []int{502, 502, 502}, maxRetries: 2, hits: 3, status: 502},
+		{name: "non retryable 4xx", statuses: []int{404}, maxRetries: 2, hits: 1, status: 404},
+		{name: "429 then success", statuses: []int{429}, maxRetries: 1, hits: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, hits := newStatusServer(t, nil, test.statuses...)
+
+			body, err := newTestClient(nil, test.maxRetries).Get(context.Background(), srv.URL, nil)
+
+			if *hits != test.hits {
+				t.Errorf("expected %d requests, got %d", test.hits, *hits)
+			}
+
+			if test.status == 0 {
+				if err != nil || string(body) != "ok" {
+					t.Errorf("expected a success, got %q, %v", body, err)
+				}
+				return
+			}
+
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status {
+				t.Errorf("expected the status %d, got %v", test.status, err)
+			}
+		})
+	}
+}
+
+func TestClientGetRetryAfter(t *testing.T) {
+	srv, hits := newStatusServer(t, http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests)
+
+	start := time.Now()
+	body, err := newTestClient(nil, 1).Get(context.Background(), srv.URL, nil)
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("expected a success, got %q, %v", body, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait for the Retry-After delay, waited %s", elapsed)
+	}
+
+	if *hits != 2 {
+		t.Errorf("expected 2 requests, got %d", *hits)
+	}
+}
+
+func TestClientGetCancelDuringBackoff(t *testing.T) {
+	srv, hits := newStatusServer(t, http.Header{"Retry-After": {"60"}}, http.StatusServiceUnavailable)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := newTestClient(nil, 3).Get(ctx, srv.URL, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the backoff wasn't interrupted, waited %s", elapsed)
+	}
+
+	if *hits != 1 {
+		t.Errorf("expected 1 request, got %d", *hits)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{value: "", min: 0, max: 0},
+		{value: "120", min: 2 * time.Minute, max: 2 * time.Minute},
+		{value: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), min: 59 * time.Minute, max: time.Hour},
+		{value: "soon", min: 0, max: 0},
+	}
+
+	for _, test := range tests {
+		res := parseRetryAfter(test.value)
+
+		if res < test.min || res > test.max {
+			t.Errorf("%q: expected between %s and %s, got %s", test.value, test.min, test.max, res)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		expected bool
+	}{
+		{"429", context.Background(), &StatusError{StatusCode: 429}, true},
+		{"503", context.Background(), &StatusError{StatusCode: 503}, true},
+		{"403", context.Background(), &StatusError{StatusCode: 403}, false},
+		{"cancelled", cancelled, &StatusError{StatusCode: 503}, false},
+		{"connection closed", context.Background(), fmt.Errorf("failed to read the body: %w", io.ErrUnexpectedEOF), true},
+		{"connection refused", context.Background(), &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"unknown host", context.Background(), &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}, false},
+		{"other error", context.Background(), errors.New("invalid url"), false},
+		{"context cancelled", context.Background(), context.Canceled, false},
+	}
+
+	for _, test := range tests {
+		if res := isRetryable(test.ctx, test.err); res != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, res)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+)
+
+// EnrichedSource wraps a RankingSource and completes its metadatas with the
+// informations provided by the GitHub API (description, license, topics,
+// etc).
+type EnrichedSource struct {
+	source RankingSource
+	github *GithubSource
+}
+
+func NewEnrichedSource(source RankingSource, github *GithubSource) *EnrichedSource {
+	return &EnrichedSource{source, github}
+}
+
+func (e *EnrichedSource) FetchLinks(ctx context.Context) ([]string, error) {
+	return e.source.FetchLinks(ctx)
+}
+
+func (e *EnrichedSource) FetchMetadataForLink(ctx context.Context, link string) (*RepoMetadata, error) {
+	meta, err := e.source.FetchMetadataForLink(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.github.Enrich(ctx, link, meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enrich the metadatas: %w", err)
+	}
+
+	return meta, nil
+}
+
+var _ RankingSource = &EnrichedSource{}
@@ -1,9 +1,11 @@
 package metadata
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"net/http"
+	"math"
 	"net/url"
 	"strconv"
 	"strings"
@@ -18,37 +20,109 @@ type RepoMetadata struct {
 	RepositoryURL     string    `json:"url"`
 	Rank              int       `json:"rank"`
 	NbStars           int       `json:"stars"`
+	NbForks           int       `json:"forks"`
+	SizeKB            int       `json:"sizeKB"` // 0 if unknown
+	Description       string    `json:"description"`
+	Language          string    `json:"language"`
+	License           string    `json:"license"` // SPDX identifier
+	Topics            []string  `json:"topics"`
+	DefaultBranch     string    `json:"defaultBranch"`
+	Archived          bool      `json:"archived"`
+	Head              string    `json:"head"` // upstream HEAD commit during the last git fetch
+	RankingUpdatedAt  time.Time `json:"rankingUpdatedAt"`
 	LastMetadataFetch time.Time `json:"lastMetadataFetch"`
+	LastGitFetch      time.Time `json:"lastGitFetch"`
 	Repo              *cid.Cid  `json:"repo"`
+	LFS               *cid.Cid  `json:"lfs"` // LFS objects directory inside Repo, nil without LFS objects
+
+	// Submodules associates the url of each submodule with the CID of its
+	// mirror. The CID is nil until the submodule is mirrored.
+	Submodules map[string]*cid.Cid `json:"submodules"`
+	// Bundles associates the name of each git bundle published inside Repo
+	// with its CID.
+	Bundles map[string]*cid.Cid `json:"bundles"`
 }
 
+// gitstarLocation is the timezone of the dates displayed by gitstar-ranking.
+// They are given without any timezone indication ("Fetched on 2022/04/05
+// 11:40"), the site being operated from Japan they use the JST time. JST has
+// no daylight saving time so a fixed zone is exact.
+var gitstarLocation = time.FixedZone("JST", 9*60*60)
+
+// Fetcher is a RankingSource scrapping the gitstar-ranking.com pages.
 type Fetcher struct {
-	url *url.URL
+	client   *Client
+	url      *url.URL
+	maxRepos int
 }
 
-func NewFetcher(urlStr string) (*Fetcher, error) {
+// NewFetcher creates a new Fetcher for the ranking located at urlStr and
+// returning at most maxRepos repositories.
+func NewFetcher(client *Client, urlStr string, maxRepos int) (*Fetcher, error) {
 	u, err := url.Parse(urlStr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse the url: %w", err)
 	}
 
+	if maxRepos <= 0 {
+		return nil, fmt.Errorf("invalid max repos %d: must be positive", maxRepos)
+	}
+
 	return &Fetcher{
-		url: u,
+		client:   client,
+		url:      u,
+		maxRepos: maxRepos,
 	}, nil
 }
 
-func (f *Fetcher) FetchLinkPage(ctx context.Context) ([]string, error) {
-	res, err := http.Get(f.url.String())
-	if err != nil {
-		return nil, fmt.Errorf("failed to get the page: %w", err)
+// FetchLinks iterates over the ranking pages and returns the links ordered by
+// rank until maxRepos links are found or a page without any new link is
+// reached.
+func (f *Fetcher) FetchLinks(ctx context.Context) ([]string, error) {
+	links := []string{}
+	seen := map[string]struct{}{}
+
+	for page := 1; len(links) < f.maxRepos; page++ {
+		pageLinks, err := f.fetchLinkPage(ctx, page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the page %d: %w", page, err)
+		}
+
+		nbNew := 0
+		for _, link := range pageLinks {
+			if _, ok := seen[link]; ok {
+				continue
+			}
+
+			seen[link] = struct{}{}
+			links = append(links, link)
+			nbNew++
+
+			if len(links) >= f.maxRepos {
+				break
+			}
+		}
+
+		if nbNew == 0 {
+			break
+		}
 	}
-	defer func() { _ = res.Body.Close() }()
 
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("invalid status: %s", res.Status)
+	return links, nil
+}
+
+func (f *Fetcher) fetchLinkPage(ctx context.Context, page int) ([]string, error) {
+	pageURL := *f.url
+	query := pageURL.Query()
+	query.Set("page", strconv.Itoa(page))
+	pageURL.RawQuery = query.Encode()
+
+	body, err := f.client.Get(ctx, pageURL.String(), nil)
+	if err != nil {
+		return nil, err
 	}
 
-	doc, err := goquery.NewDocumentFromReader(res.Body)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse the HTML: %w", err)
 	}
@@ -76,17 +150,12 @@ func (f *Fetcher) FetchMetadataForLink(ctx context.Context, link string) (*RepoM
 		return nil, fmt.Errorf("failed to parse the link %q: %w", link, err)
 	}
 
-	res, err := http.Get(url.String())
+	body, err := f.client.Get(ctx, url.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get the page: %w", err)
-	}
-	defer func() { _ = res.Body.Close() }()
-
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("invalid status code: %s", res.Status)
+		return nil, err
 	}
 
-	doc, err := goquery.NewDocumentFromReader(res.Body)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse the HTML: %w", err)
 	}
@@ -96,49 +165,54 @@ func (f *Fetcher) FetchMetadataForLink(ctx context.Context, link string) (*RepoM
 		return nil, fmt.Errorf("failed to parse the rank and stars: %w", err)
 	}
 
-	lastUpdateDate, err := f.parseLastUpdateDate(doc)
+	rankingUpdatedAt, err := f.parseLastUpdateDate(doc)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse the last update date: %w", err)
 	}
 
-	repoURL, err := url.Parse("https://github.com/" + link)
+	repoURL, err := RepositoryURLForLink(link)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse the repo url: %w", err)
+		return nil, err
 	}
 
-	return &RepoMetadata{
-		RepositoryURL:     repoURL.String(),
+	meta := &RepoMetadata{
+		RepositoryURL:     repoURL,
 		Rank:              rank,
 		NbStars:           stars,
-		LastMetadataFetch: lastUpdateDate,
+		RankingUpdatedAt:  rankingUpdatedAt,
+		LastMetadataFetch: time.Now(),
 		Repo:              nil,
-	}, nil
+	}
+
+	return meta, nil
 }
 
 func (f *Fetcher) parseLastUpdateDate(doc *goquery.Document) (time.Time, error) {
 	rawLastUpdate := doc.Find(".queued_at").Text()
 
-	// Expect the following format: "Fetch on 2022/04/05 11:40"
-	lastUpdateParts := strings.Split(rawLastUpdate, "on")
+	// Expect the following format: "Fetched on 2022/04/05 11:40"
+	lastUpdateParts := strings.SplitN(rawLastUpdate, " on ", 2)
 	if len(lastUpdateParts) != 2 {
-		return time.Time{}, fmt.Errorf("invalid format, can't separate the date: %q", lastUpdateParts)
+		return time.Time{}, fmt.Errorf("invalid format, can't separate the date: %q", rawLastUpdate)
 	}
 
 	rawDate := strings.TrimSpace(lastUpdateParts[1])
 
-	lastUpdate, err := time.Parse("2006/01/02 15:04", rawDate)
+	lastUpdate, err := time.ParseInLocation("2006/01/02 15:04", rawDate, gitstarLocation)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("failed to parse the lastUpdate time %q: %w", rawDate, err)
 	}
 
-	return lastUpdate, nil
+	return lastUpdate.UTC(), nil
 }
 
 func (f *Fetcher) parseRankAndStars(doc *goquery.Document) (int, int, error) {
 	var (
-		rank  int
-		stars int
-		err   error
+		rank     int
+		stars    int
+		err      error
+		hasRank  bool
+		hasStars bool
 	)
 
 	doc.Find(".repository_info").Each(func(i int, s *goquery.Selection) {
@@ -146,22 +220,88 @@ func (f *Fetcher) parseRankAndStars(doc *goquery.Document) (int, int, error) {
 			attribute := strings.TrimSpace(s2.Find(".repository_attribute").Text())
 			rawValue := strings.TrimSpace(s2.Find(".repository_value").Text())
 
-			value, err := strconv.Atoi(rawValue)
-			if err != nil {
-				err = multierr.Append(err, fmt.Errorf("failed to parse the value of attribute %q: %w", attribute, err))
+			switch attribute {
+			case "Star":
+				hasStars = true
+			case "Rank":
+				hasRank = true
+			default:
+				return
+			}
+
+			value, parseErr := parseCount(rawValue)
+			if parseErr != nil {
+				err = multierr.Append(err, fmt.Errorf("failed to parse the value of attribute %q: %w", attribute, parseErr))
 				return
 			}
 
 			switch attribute {
 			case "Star":
 				stars = value
-				break
 			case "Rank":
 				rank = value
-				break
 			}
 		})
 	})
 
+	if !hasRank {
+		err = multierr.Append(err, errors.New("attribute \"Rank\" not found"))
+	}
+
+	if !hasStars {
+		err = multierr.Append(err, errors.New("attribute \"Star\" not found"))
+	}
+
 	return rank, stars, err
 }
+
+// parseCount parses the numbers displayed by gitstar-ranking. They can
+// contain thousands separators ("12,345") or be abbreviated with a "k" or "m"
+// suffix ("12.3k").
+func parseCount(raw string) (int, error) {
+	value := strings.ToLower(strings.TrimSpace(raw))
+	value = strings.NewReplacer(",", "", " ", "", "_", "").Replace(value)
+
+	if value == "" {
+		return 0, errors.New("empty value")
+	}
+
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1_000
+		value = strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1_000_000
+		value = strings.TrimSuffix(value, "m")
+	}
+
+	if multiplier == 1 {
+		res, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q: %w", raw, err)
+		}
+
+		if res < 0 {
+			return 0, fmt.Errorf("invalid number %q: negative count", raw)
+		}
+
+		return res, nil
+	}
+
+	res, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q: %w", raw, err)
+	}
+
+	// ParseFloat accepts "inf" and "nan", and the conversion of an out of
+	// range float to int is implementation-defined.
+	res = math.Round(res * multiplier)
+	if math.IsNaN(res) || res < 0 || res > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid number %q: out of range", raw)
+	}
+
+	return int(res), nil
+}
+
+var _ RankingSource = &Fetcher{}
@@ -0,0 +1,270 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"go.uber.org/multierr"
+)
+
+// newFixtureServer serves the ranking pages from the testdata directory: the
+// first list page and an empty second one, and a repository page per link.
+// The fixtures only reproduce the markup read by the scraper.
+func newFixtureServer(t *testing.T, repoPages map[string]string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fixture := ""
+		switch {
+		case r.URL.Path == "/repositories" && r.URL.Query().Get("page") == "1":
+			fixture = "repositories.html"
+		case r.URL.Path == "/repositories":
+			fixture = "repositories_empty.html"
+		default:
+			fixture = repoPages[strings.TrimPrefix(r.URL.Path, "/")]
+		}
+
+		if fixture == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeFile(w, r, filepath.Join("testdata", fixture))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func loadFixture(t *testing.T, name string) *goquery.Document {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return doc
+}
+
+func TestParseCount(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected int
+		wantErr  bool
+	}{
+		{raw: "42", expected: 42},
+		{raw: " 7 ", expected: 7},
+		{raw: "12,345", expected: 12345},
+		{raw: "1,234,567", expected: 1234567},
+		{raw: "1.2k", expected: 1200},
+		{raw: "12.3K", expected: 12300},
+		{raw: "999k", expected: 999000},
+		{raw: "1.5m", expected: 1500000},
+		{raw: "", wantErr: true},
+		{raw: "many", wantErr: true},
+		{raw: "1.2.3k", wantErr: true},
+		{raw: "1.5", wantErr: true},
+		{raw: "-12", wantErr: true},
+		{raw: "-1.2k", wantErr: true},
+		{raw: "infk", wantErr: true},
+		{raw: "nanm", wantErr: true},
+		{raw: "1e300k", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.raw, func(t *testing.T) {
+			res, err := parseCount(test.raw)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d", res)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if res != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, res)
+			}
+		})
+	}
+}
+
+func TestFetcherParseRankAndStars(t *testing.T) {
+	tests := []struct {
+		fixture string
+		rank    int
+		stars   int
+		errs    []string
+	}{
+		{fixture: "repository.html", rank: 1, stars: 356345},
+		{fixture: "repository_abbreviated.html", rank: 1024, stars: 1200},
+		{
+			fixture: "repository_missing.html",
+			errs: []string{
+				`attribute "Rank" not found`,
+				`attribute "Star" not found`,
+			},
+		},
+		{
+			// The parse errors were lost, shadowed by the closure variable.
+			fixture: "repository_invalid.html",
+			errs: []string{
+				`failed to parse the value of attribute "Rank"`,
+				`failed to parse the value of attribute "Star"`,
+			},
+		},
+	}
+
+	f := &Fetcher{}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			rank, stars, err := f.parseRankAndStars(loadFixture(t, test.fixture))
+
+			errs := multierr.Errors(err)
+			if len(errs) != len(test.errs) {
+				t.Fatalf("expected %d errors, got %d: %v", len(test.errs), len(errs), err)
+			}
+
+			for i, expected := range test.errs {
+				if !strings.Contains(errs[i].Error(), expected) {
+					t.Errorf("expected the error %d to contain %q, got %q", i, expected, errs[i])
+				}
+			}
+
+			if rank != test.rank || stars != test.stars {
+				t.Errorf("expected rank %d and stars %d, got %d and %d", test.rank, test.stars, rank, stars)
+			}
+		})
+	}
+}
+
+func TestFetcherFetchLinks(t *testing.T) {
+	srv := newFixtureServer(t, nil)
+	client := NewClient(nil, time.Second, 0, 0, 1)
+
+	tests := []struct {
+		maxRepos int
+		expected []string
+	}{
+		{
+			maxRepos: 1000,
+			expected: []string{"freeCodeCamp/freeCodeCamp", "996icu/996.ICU", "EbookFoundation/free-programming-books"},
+		},
+		{
+			maxRepos: 2,
+			expected: []string{"freeCodeCamp/freeCodeCamp", "996icu/996.ICU"},
+		},
+	}
+
+	for _, test := range tests {
+		f, err := NewFetcher(client, srv.URL+"/repositories", test.maxRepos)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		links, err := f.FetchLinks(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if !reflect.DeepEqual(links, test.expected) {
+			t.Errorf("max repos %d: expected %v, got %v", test.maxRepos, test.expected, links)
+		}
+	}
+}
+
+func TestFetcherFetchMetadataForLink(t *testing.T) {
+	srv := newFixtureServer(t, map[string]string{
+		"freeCodeCamp/freeCodeCamp": "repository.html",
+		"996icu/996.ICU":            "repository_missing.html",
+	})
+
+	f, err := NewFetcher(NewClient(nil, time.Second, 0, 0, 1), srv.URL+"/repositories", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := f.FetchMetadataForLink(context.Background(), "freeCodeCamp/freeCodeCamp")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	meta.LastMetadataFetch = time.Time{}
+
+	expected := &RepoMetadata{
+		RepositoryURL:    "https://github.com/freeCodeCamp/freeCodeCamp",
+		Rank:             1,
+		NbStars:          356345,
+		RankingUpdatedAt: time.Date(2022, 4, 5, 2, 40, 0, 0, time.UTC),
+	}
+
+	if !reflect.DeepEqual(meta, expected) {
+		t.Errorf("expected %+v, got %+v", expected, meta)
+	}
+
+	_, err = f.FetchMetadataForLink(context.Background(), "996icu/996.ICU")
+	if len(multierr.Errors(errors.Unwrap(err))) != 2 {
+		t.Errorf("expected the two missing attributes to be reported, got %v", err)
+	}
+}
+
+func TestFetcherParseLastUpdateDate(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected time.Time
+		wantErr  bool
+	}{
+		// gitstar-ranking displays the JST time (UTC+9).
+		{raw: "Fetched on 2022/04/05 11:40", expected: time.Date(2022, 4, 5, 2, 40, 0, 0, time.UTC)},
+		{raw: "\n  Fetched on 2022/01/01 03:15\n", expected: time.Date(2021, 12, 31, 18, 15, 0, 0, time.UTC)},
+		{raw: "", wantErr: true},
+		{raw: "Fetched 2022/04/05 11:40", wantErr: true},
+		{raw: "Fetched on yesterday", wantErr: true},
+	}
+
+	f := &Fetcher{}
+
+	for _, test := range tests {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<span class="queued_at">` + test.raw + `</span>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := f.parseLastUpdateDate(doc)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.raw, res)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.raw, err)
+			continue
+		}
+
+		if !res.Equal(test.expected) || res.Location() != time.UTC {
+			t.Errorf("%q: expected %s, got %s", test.raw, test.expected, res)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	githubSearchPageSize = 100
+	// The search API never returns more than 1000 results for a query.
+	githubSearchMaxResults = 1000
+)
+
+type githubRepo struct {
+	FullName      string   `json:"full_name"`
+	HTMLURL       string   `json:"html_url"`
+	Description   string   `json:"description"`
+	Language      string   `json:"language"`
+	Topics        []string `json:"topics"`
+	Stars         int      `json:"stargazers_count"`
+	Forks         int      `json:"forks_count"`
+	Size          int      `json:"size"`
+	DefaultBranch string   `json:"default_branch"`
+	Archived      bool     `json:"archived"`
+	License       *struct {
+		SPDXID string `json:"spdx_id"`
+	} `json:"license"`
+}
+
+// fill sets the metadata fields provided by GitHub. The fields already set
+// are not overwritten.
+func (r *githubRepo) fill(meta *RepoMetadata) {
+	if meta.RepositoryURL == "" {
+		meta.RepositoryURL = r.HTMLURL
+	}
+
+	if meta.NbStars == 0 {
+		meta.NbStars = r.Stars
+	}
+
+	if meta.NbForks == 0 {
+		meta.NbForks = r.Forks
+	}
+
+	if meta.SizeKB == 0 {
+		meta.SizeKB = r.Size
+	}
+
+	if meta.Description == "" {
+		meta.Description = r.Description
+	}
+
+	if meta.Language == "" {
+		meta.Language = r.Language
+	}
+
+	// GitHub uses "NOASSERTION" for the licenses it can't identify.
+	if meta.License == "" && r.License != nil && r.License.SPDXID != "NOASSERTION" {
+		meta.License = r.License.SPDXID
+	}
+
+	if len(meta.Topics) == 0 {
+		meta.Topics = r.Topics
+	}
+
+	if meta.DefaultBranch == "" {
+		meta.DefaultBranch = r.DefaultBranch
+	}
+
+	meta.Archived = meta.Archived || r.Archived
+}
+
+type githubSearchResult struct {
+	TotalCount int          `json:"total_count"`
+	Items      []githubRepo `json:"items"`
+}
+
+// GithubSource is a RankingSource based on the GitHub search API.
+type GithubSource struct {
+	client   *Client
+	apiURL   *url.URL
+	query    string
+	token    string
+	maxRepos int
+
+	lock  sync.Mutex
+	ranks map[string]int
+	repos map[string]githubRepo
+}
+
+// NewGithubSource creates a new GithubSource listing the repositories
+// matching the given search query (ex: "stars:>10000") ordered by stars.
+//
+// The token is optional but the unauthenticated requests are heavily rate
+// limited. The search API can't return more than 1000 repositories, maxRepos
+// is capped to this value.
+func NewGithubSource(client *Client, apiURL string, query string, token string, maxRepos int) (*GithubSource, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the url: %w", err)
+	}
+
+	if maxRepos <= 0 {
+		return nil, fmt.Errorf("invalid max repos %d: must be positive", maxRepos)
+	}
+
+	if maxRepos > githubSearchMaxResults {
+		maxRepos = githubSearchMaxResults
+	}
+
+	return &GithubSource{
+		client:   client,
+		apiURL:   u,
+		query:    query,
+		token:    token,
+		maxRepos: maxRepos,
+		ranks:    map[string]int{},
+		repos:    map[string]githubRepo{},
+	}, nil
+}
+
+func (g *GithubSource) FetchLinks(ctx context.Context) ([]string, error) {
+	links := []string{}
+	ranks := map[string]int{}
+	repos := map[string]githubRepo{}
+
+	for page := 1; len(links) < g.maxRepos; page++ {
+		var res githubSearchResult
+
+		err := g.get(ctx, "search/repositories", url.Values{
+			"q":        []string{g.query},
+			"sort":     []string{"stars"},
+			"order":    []string{"desc"},
+			"per_page": []string{strconv.Itoa(githubSearchPageSize)},
+			"page":     []string{strconv.Itoa(page)},
+		}, &res)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the search page %d: %w", page, err)
+		}
+
+		for _, repo := range res.Items {
+			if _, ok := repos[repo.FullName]; ok {
+				continue
+			}
+
+			links = append(links, repo.FullName)
+			ranks[repo.FullName] = len(links)
+			repos[repo.FullName] = repo
+
+			if len(links) >= g.maxRepos {
+				break
+			}
+		}
+
+		if len(res.Items) < githubSearchPageSize || len(links) >= res.TotalCount {
+			break
+		}
+	}
+
+	g.lock.Lock()
+	g.ranks = ranks
+	g.repos = repos
+	g.lock.Unlock()
+
+	return links, nil
+}
+
+func (g *GithubSource) FetchMetadataForLink(ctx context.Context, link string) (*RepoMetadata, error) {
+	g.lock.Lock()
+	repo, ok := g.repos[link]
+	rank := g.ranks[link]
+	g.lock.Unlock()
+
+	if !ok {
+		err := g.get(ctx, "repos/"+link, nil, &repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the repository %q: %w", link, err)
+		}
+	}
+
+	meta := &RepoMetadata{
+		Rank:              rank,
+		LastMetadataFetch: time.Now(),
+		Repo:              nil,
+	}
+	repo.fill(meta)
+
+	return meta, nil
+}
+
+// Enrich completes the metadata with the fields provided by the GitHub API.
+// The repositories not hosted on GitHub are left untouched.
+func (g *GithubSource) Enrich(ctx context.Context, link string, meta *RepoMetadata) error {
+	if strings.Count(strings.Trim(link, "/"), "/") != 1 {
+		return nil
+	}
+
+	var repo githubRepo
+	err := g.get(ctx, "repos/"+link, nil, &repo)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the repository %q: %w", link, err)
+	}
+
+	repo.fill(meta)
+
+	return nil
+}
+
+func (g *GithubSource) get(ctx context.Context, path string, query url.Values, res interface{}) error {
+	u, err := g.apiURL.Parse(path)
+	if err != nil {
+		return fmt.Errorf("failed to parse the path %q: %w", path, err)
+	}
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github.v3+json")
+	if g.token != "" {
+		header.Set("Authorization", "token "+g.token)
+	}
+
+	body, err := g.client.Get(ctx, u.String(), header)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(body, res)
+	if err != nil {
+		return fmt.Errorf("failed to decode the response: %w", err)
+	}
+
+	return nil
+}
+
+var _ RankingSource = &GithubSource{}
@@ -0,0 +1,63 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := newRateLimiter(20, 2)
+
+	// The burst is available at once.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		err := limiter.Wait(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Errorf("expected the burst to be immediate, waited %s", elapsed)
+	}
+
+	// The next token comes after 1/rate second.
+	err := limiter.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected to wait for a token, waited %s", elapsed)
+	}
+}
+
+func TestRateLimiterWaitCancel(t *testing.T) {
+	limiter := newRateLimiter(0.01, 1)
+
+	err := limiter.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = limiter.Wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := newRateLimiter(0, 1)
+
+	for i := 0; i < 100; i++ {
+		err := limiter.Wait(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
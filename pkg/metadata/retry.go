@@ -0,0 +1,64 @@
+package metadata
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RetryPolicy retries the transient errors with an exponential backoff,
+// honoring the delay requested by the server up to maxRetryAfter. It's the
+// policy of the Client, shared with the other HTTP clients of the daemon.
+type RetryPolicy struct {
+	MaxRetries int
+	MinBackoff time.Duration
+}
+
+// NewRetryPolicy returns a policy retrying maxRetries times.
+func NewRetryPolicy(maxRetries int) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: maxRetries,
+		MinBackoff: minBackoff,
+	}
+}
+
+// Do calls fn until it succeeds, fails with a final error or the retries are
+// exhausted. fn returns the delay requested by the server, if any, with its
+// error. The *StatusError with a 429 or 5xx status are retried.
+func (p RetryPolicy) Do(ctx context.Context, name string, fn func() (time.Duration, error)) error {
+	backoff := p.MinBackoff
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= p.MaxRetries || !isRetryable(ctx, err) {
+			return err
+		}
+
+		delay := backoff
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if delay > maxRetryAfter {
+			delay = maxRetryAfter
+		}
+
+		log.Printf("%s failed, retry in %s: %s", name, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
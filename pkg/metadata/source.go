@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// githubOwnerRegexp matches the GitHub user and organization names,
+	// they never contain a dot unlike the hosts.
+	githubOwnerRegexp = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,38})$`)
+	githubRepoRegexp  = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+	// scpURLRegexp matches the scp-like syntax of the SSH urls
+	// ("git@host:owner/repo"). The user is required in order to not confuse
+	// it with a link containing a port ("host:8080/owner/repo").
+	scpURLRegexp = regexp.MustCompile(`^([^@/:]+)@([^@/:]+):(.+)$`)
+)
+
+// RankingSource provides the list of repositories to mirror and their
+// metadatas.
+//
+// A link identify a repository inside a source. For the GitHub repositories
+// it's the "owner/repo" couple, for the other hosts it's the repository URL
+// without the scheme (ex: "git.example.com/team/repo").
+type RankingSource interface {
+	FetchLinks(ctx context.Context) ([]string, error)
+	FetchMetadataForLink(ctx context.Context, link string) (*RepoMetadata, error)
+}
+
+// RepositoryURLForLink returns the clone url of the repository identified by
+// the given link. A repository url is accepted as link, the clone url is
+// always an https one.
+func RepositoryURLForLink(link string) (string, error) {
+	if isRepositoryURL(link) {
+		var err error
+		link, err = LinkForRepositoryURL(link)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	link = strings.Trim(link, "/")
+
+	parts := strings.Split(link, "/")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("invalid link %q: expect at least \"owner/repo\"", link)
+	}
+
+	var rawURL string
+	if len(parts) == 2 {
+		if !githubOwnerRegexp.MatchString(parts[0]) || !githubRepoRegexp.MatchString(parts[1]) {
+			return "", fmt.Errorf("invalid link %q: expect \"owner/repo\" for GitHub or \"host/owner/repo\"", link)
+		}
+
+		rawURL = "https://github.com/" + link
+	} else {
+		rawURL = "https://" + link
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the repo url: %w", err)
+	}
+
+	return u.String(), nil
+}
+
+// LinkForRepositoryURL is the reverse of RepositoryURLForLink. The ssh://
+// and scp-like ("git@host:owner/repo") urls give the link of the same
+// repository served over https.
+func LinkForRepositoryURL(repoURL string) (string, error) {
+	rawURL := repoURL
+	if m := scpURLRegexp.FindStringSubmatch(repoURL); m != nil && !strings.Contains(repoURL, "://") {
+		rawURL = fmt.Sprintf("ssh://%s@%s/%s", m[1], m[2], strings.TrimPrefix(m[3], "/"))
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the url %q: %w", repoURL, err)
+	}
+
+	host := u.Host
+	if u.Scheme == "ssh" || u.Scheme == "git" {
+		// Their port doesn't identify the repository.
+		host = u.Hostname()
+	}
+
+	if host == "" {
+		return "", fmt.Errorf("invalid repository url %q: no host", repoURL)
+	}
+
+	path := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if path == "" {
+		return "", fmt.Errorf("invalid repository url %q: no path", repoURL)
+	}
+
+	if host == "github.com" {
+		return path, nil
+	}
+
+	return host + "/" + path, nil
+}
+
+// isRepositoryURL returns true if s is a repository url rather than a link.
+func isRepositoryURL(s string) bool {
+	return strings.Contains(s, "://") || scpURLRegexp.MatchString(s)
+}
@@ -0,0 +1,65 @@
+package metadata
+
+import "testing"
+
+func TestLinkForRepositoryURL(t *testing.T) {
+	tests := []struct {
+		repoURL  string
+		expected string
+	}{
+		{repoURL: "https://github.com/torvalds/linux", expected: "torvalds/linux"},
+		{repoURL: "https://github.com/torvalds/linux.git", expected: "torvalds/linux"},
+		{repoURL: "https://git.example.com/team/repo", expected: "git.example.com/team/repo"},
+		{repoURL: "https://git.example.com:8443/team/repo", expected: "git.example.com:8443/team/repo"},
+		{repoURL: "ssh://git@github.com/torvalds/linux.git", expected: "torvalds/linux"},
+		{repoURL: "ssh://git@git.example.com:2222/team/repo", expected: "git.example.com/team/repo"},
+		{repoURL: "git@github.com:torvalds/linux.git", expected: "torvalds/linux"},
+		{repoURL: "git@git.example.com:team/repo", expected: "git.example.com/team/repo"},
+	}
+
+	for _, test := range tests {
+		link, err := LinkForRepositoryURL(test.repoURL)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.repoURL, err)
+			continue
+		}
+
+		if link != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.repoURL, test.expected, link)
+		}
+	}
+}
+
+func TestRepositoryURLForLink(t *testing.T) {
+	tests := []struct {
+		link     string
+		expected string
+		wantErr  bool
+	}{
+		{link: "torvalds/linux", expected: "https://github.com/torvalds/linux"},
+		{link: "git.example.com/team/repo", expected: "https://git.example.com/team/repo"},
+		{link: "git@git.example.com:team/repo", expected: "https://git.example.com/team/repo"},
+		{link: "ssh://git@github.com/torvalds/linux", expected: "https://github.com/torvalds/linux"},
+		{link: "gitlab.com/repo", wantErr: true},
+		{link: "linux", wantErr: true},
+	}
+
+	for _, test := range tests {
+		repoURL, err := RepositoryURLForLink(test.link)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.link, repoURL)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.link, err)
+			continue
+		}
+
+		if repoURL != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.link, test.expected, repoURL)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StaticSource is a RankingSource reading a curated list of repositories
+// from a YAML or JSON file.
+//
+// The file contains a list of "owner/repo" for the GitHub repositories or
+// full repository URLs for the other hosts:
+//
+//	# repositories.yaml
+//	- torvalds/linux
+//	- https://git.example.com/team/repo
+//	- git@git.example.com:team/other-repo
+//
+// The repositories are identified by the link of their https url, the SSH
+// urls are only a way to write them.
+//
+// The rank of each repository is its position inside the list, a repository
+// listed twice keeps its first position. The file is read again by each
+// FetchLinks call, the metadatas use the ranks read by the last one.
+type StaticSource struct {
+	path string
+
+	lock  sync.Mutex
+	ranks map[string]int // nil until the file is read
+}
+
+func NewStaticSource(path string) *StaticSource {
+	return &StaticSource{path: path}
+}
+
+func (s *StaticSource) FetchLinks(ctx context.Context) ([]string, error) {
+	links, err := s.readLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	ranks := make(map[string]int, len(links))
+	for i, link := range links {
+		ranks[link] = i + 1
+	}
+
+	s.lock.Lock()
+	s.ranks = ranks
+	s.lock.Unlock()
+
+	return links, nil
+}
+
+func (s *StaticSource) readLinks() ([]string, error) {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the file %q: %w", s.path, err)
+	}
+
+	entries := []string{}
+	// JSON being a subset of YAML, the same decoder handle both formats.
+	err = yaml.Unmarshal(raw, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the file %q: %w", s.path, err)
+	}
+
+	links := make([]string, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		link := entry
+		if isRepositoryURL(entry) {
+			link, err = LinkForRepositoryURL(entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Reject the ambiguous links before any work is done on them.
+		_, err = RepositoryURLForLink(link)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry in %q: %w", s.path, err)
+		}
+
+		if _, ok := seen[link]; ok {
+			continue
+		}
+		seen[link] = struct{}{}
+
+		links = append(links, link)
+	}
+
+	return links, nil
+}
+
+func (s *StaticSource) FetchMetadataForLink(ctx context.Context, link string) (*RepoMetadata, error) {
+	s.lock.Lock()
+	loaded := s.ranks != nil
+	s.lock.Unlock()
+
+	if !loaded {
+		_, err := s.FetchLinks(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.lock.Lock()
+	rank, ok := s.ranks[link]
+	s.lock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("link %q not found in %q", link, s.path)
+	}
+
+	repoURL, err := RepositoryURLForLink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RepoMetadata{
+		RepositoryURL:     repoURL,
+		Rank:              rank,
+		LastMetadataFetch: time.Now(),
+		Repo:              nil,
+	}, nil
+}
+
+var _ RankingSource = &StaticSource{}
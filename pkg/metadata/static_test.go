@@ -0,0 +1,47 @@
+package metadata
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStaticSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repositories.yaml")
+	err := os.WriteFile(path, []byte(`
+- torvalds/linux
+- https://git.example.com/team/repo
+- golang/go
+- https://github.com/torvalds/linux
+- git@git.example.com:team/repo
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := NewStaticSource(path)
+
+	links, err := source.FetchLinks(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The repositories listed twice keep their first rank.
+	expected := []string{"torvalds/linux", "git.example.com/team/repo", "golang/go"}
+	if !reflect.DeepEqual(links, expected) {
+		t.Fatalf("expected %v, got %v", expected, links)
+	}
+
+	for i, link := range expected {
+		meta, err := source.FetchMetadataForLink(context.Background(), link)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", link, err)
+		}
+
+		if meta.Rank != i+1 {
+			t.Errorf("%s: expected the rank %d, got %d", link, i+1, meta.Rank)
+		}
+	}
+}
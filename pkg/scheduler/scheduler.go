@@ -0,0 +1,286 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Options configures the Scheduler.
+type Options struct {
+	// CheckInterval is the delay between two checks of the upstream HEAD of
+	// a repository.
+	CheckInterval time.Duration
+	// MaxAge is the age after which a mirror is published again even if its
+	// upstream HEAD didn't move. Zero disables it.
+	MaxAge time.Duration
+}
+
+// Repo is a repository listed by the ranking source.
+type Repo struct {
+	Link string
+	Rank int // 1 for the most popular repository
+	// LastCheck and LastMirror restore the history of a repository known
+	// before the scheduler start. They are ignored for the repositories
+	// already scheduled.
+	LastCheck  time.Time
+	LastMirror time.Time
+}
+
+// Task is a repository to process.
+type Task struct {
+	Link string
+	Rank int
+	// Force is set when the mirror is older than MaxAge, the repository
+	// must be published again even if it didn't change.
+	Force bool
+}
+
+// Entry is the schedule of a repository.
+type Entry struct {
+	Link       string    `json:"link"`
+	Rank       int       `json:"rank"`
+	NextRun    time.Time `json:"nextRun"`
+	Force      bool      `json:"force"`
+	Running    bool      `json:"running"`
+	LastCheck  time.Time `json:"lastCheck"`
+	LastMirror time.Time `json:"lastMirror"`
+	// LastAttempt is the date of the last failed processing, the repository
+	// is retried after CheckInterval.
+	LastAttempt time.Time `json:"lastAttempt,omitempty"`
+}
+
+// Scheduler decides when each repository of the ranking list is processed
+// again.
+//
+// A repository is due when its upstream HEAD was not checked for
+// CheckInterval, or when its mirror is older than MaxAge. The due
+// repositories are returned by rank, the most popular first, then by the
+// date of their last check, the oldest first.
+type Scheduler struct {
+	clock Clock
+	opts  Options
+
+	lock  sync.Mutex
+	repos map[string]*Entry
+}
+
+func New(clock Clock, opts Options) *Scheduler {
+	return &Scheduler{
+		clock: clock,
+		opts:  opts,
+		repos: map[string]*Entry{},
+	}
+}
+
+// SetRepos replaces the ranking list. The repositories already scheduled
+// keep their history with their new rank, the ones not listed anymore are
+// removed once they are not running.
+func (s *Scheduler) SetRepos(repos []Repo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	listed := make(map[string]struct{}, len(repos))
+
+	for _, repo := range repos {
+		listed[repo.Link] = struct{}{}
+
+		entry, ok := s.repos[repo.Link]
+		if !ok {
+			entry = &Entry{
+				Link:       repo.Link,
+				LastCheck:  repo.LastCheck,
+				LastMirror: repo.LastMirror,
+			}
+			s.repos[repo.Link] = entry
+		}
+
+		entry.Rank = repo.Rank
+	}
+
+	for link, entry := range s.repos {
+		if _, ok := listed[link]; !ok && !entry.Running {
+			delete(s.repos, link)
+		}
+	}
+}
+
+// Due returns the repositories to process now, by rank, and marks them as
+// running until Done or Release is called.
+func (s *Scheduler) Due() []Task {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+
+	entries := []*Entry{}
+	for _, entry := range s.repos {
+		if !entry.Running && !s.nextRun(entry).After(now) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sortByRank(entries)
+
+	res := make([]Task, 0, len(entries))
+	for _, entry := range entries {
+		entry.Running = true
+		res = append(res, Task{
+			Link:  entry.Link,
+			Rank:  entry.Rank,
+			Force: s.expired(entry, now),
+		})
+	}
+
+	return res
+}
+
+// Done records the end of the processing of a repository. mirrored is true
+// if a new version was published.
+func (s *Scheduler) Done(link string, mirrored bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.repos[link]
+	if !ok {
+		return
+	}
+
+	now := s.clock.Now()
+
+	entry.Running = false
+	entry.LastCheck = now
+	entry.LastAttempt = time.Time{}
+	if mirrored {
+		entry.LastMirror = now
+	}
+}
+
+// Release ends the processing of a repository which failed or was
+// interrupted. Its history is kept, it's due again after CheckInterval.
+func (s *Scheduler) Release(link string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.repos[link]
+	if !ok {
+		return
+	}
+
+	entry.Running = false
+	entry.LastAttempt = s.clock.Now()
+}
+
+// NextRun returns the date of the next due repository, false if there is
+// none.
+func (s *Scheduler) NextRun() (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var res time.Time
+	found := false
+
+	for _, entry := range s.repos {
+		if entry.Running {
+			continue
+		}
+
+		next := s.nextRun(entry)
+		if !found || next.Before(res) {
+			res = next
+			found = true
+		}
+	}
+
+	return res, found
+}
+
+// Queue returns the schedule of every repository, by next run then by rank.
+// The running repositories come first.
+func (s *Scheduler) Queue() []Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+
+	entries := make([]*Entry, 0, len(s.repos))
+	for _, entry := range s.repos {
+		e := *entry
+		e.NextRun = s.nextRun(entry)
+		e.Force = s.expired(entry, now)
+		entries = append(entries, &e)
+	}
+
+	sortByRank(entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Running != entries[j].Running {
+			return entries[i].Running
+		}
+
+		// The due repositories are ordered by rank only.
+		a, b := entries[i].NextRun, entries[j].NextRun
+		if !a.After(now) && !b.After(now) {
+			return false
+		}
+
+		return a.Before(b)
+	})
+
+	res := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		res = append(res, *entry)
+	}
+
+	return res
+}
+
+// nextRun returns the date at which the repository must be processed, the
+// lock must be held.
+func (s *Scheduler) nextRun(entry *Entry) time.Time {
+	var next time.Time
+
+	if !entry.LastCheck.IsZero() {
+		next = entry.LastCheck.Add(s.opts.CheckInterval)
+
+		if s.opts.MaxAge > 0 && !entry.LastMirror.IsZero() {
+			expiry := entry.LastMirror.Add(s.opts.MaxAge)
+			if expiry.Before(next) {
+				next = expiry
+			}
+		}
+	}
+
+	if !entry.LastAttempt.IsZero() {
+		retry := entry.LastAttempt.Add(s.opts.CheckInterval)
+		if retry.After(next) {
+			next = retry
+		}
+	}
+
+	return next
+}
+
+// expired returns true if the mirror is older than MaxAge.
+func (s *Scheduler) expired(entry *Entry, now time.Time) bool {
+	return s.opts.MaxAge > 0 && !entry.LastMirror.IsZero() && !entry.LastMirror.Add(s.opts.MaxAge).After(now)
+}
+
+// sortByRank sorts the entries by rank, the unranked ones (zero) last, then
+// by last check, the oldest first.
+func sortByRank(entries []*Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Rank, entries[j].Rank
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		if a != b {
+			return a < b
+		}
+
+		if !entries[i].LastCheck.Equal(entries[j].LastCheck) {
+			return entries[i].LastCheck.Before(entries[j].LastCheck)
+		}
+
+		return entries[i].Link < entries[j].Link
+	})
+}
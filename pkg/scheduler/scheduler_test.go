@@ -0,0 +1,176 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2022, 4, 5, 11, 40, 0, 0, time.UTC)
+
+func dueLinks(tasks []Task) []string {
+	res := []string{}
+	for _, task := range tasks {
+		res = append(res, task.Link)
+	}
+
+	return res
+}
+
+func queueLinks(entries []Entry) []string {
+	res := []string{}
+	for _, entry := range entries {
+		res = append(res, entry.Link)
+	}
+
+	return res
+}
+
+func TestSchedulerDue(t *testing.T) {
+	clock := NewFakeClock(start)
+	sched := New(clock, Options{CheckInterval: time.Hour})
+
+	sched.SetRepos([]Repo{
+		{Link: "owner/third", Rank: 3},
+		{Link: "owner/unranked-recent", LastCheck: start.Add(-2 * time.Hour)},
+		{Link: "owner/first", Rank: 1},
+		{Link: "owner/unranked-old", LastCheck: start.Add(-3 * time.Hour)},
+		{Link: "owner/checked", Rank: 2, LastCheck: start.Add(-time.Minute)},
+	})
+
+	expected := []string{"owner/first", "owner/third", "owner/unranked-old", "owner/unranked-recent"}
+	if res := dueLinks(sched.Due()); !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+
+	// The running repositories are not due again.
+	if res := sched.Due(); len(res) != 0 {
+		t.Errorf("expected no due repository, got %v", dueLinks(res))
+	}
+
+	clock.Advance(time.Hour)
+
+	if res := dueLinks(sched.Due()); !reflect.DeepEqual(res, []string{"owner/checked"}) {
+		t.Errorf("expected owner/checked, got %v", res)
+	}
+}
+
+func TestSchedulerNextRun(t *testing.T) {
+	clock := NewFakeClock(start)
+	sched := New(clock, Options{CheckInterval: time.Hour})
+
+	if _, ok := sched.NextRun(); ok {
+		t.Errorf("expected no next run without repository")
+	}
+
+	sched.SetRepos([]Repo{
+		{Link: "owner/first", Rank: 1},
+		{Link: "owner/second", Rank: 2, LastCheck: start.Add(-2 * time.Hour)},
+	})
+
+	// A repository never checked is due now.
+	if next, ok := sched.NextRun(); !ok || !next.IsZero() {
+		t.Errorf("expected a repository due now, got %s", next)
+	}
+
+	for _, task := range sched.Due() {
+		if task.Link == "owner/first" {
+			sched.Done(task.Link, true)
+		}
+	}
+
+	// owner/second is running, owner/first is due after CheckInterval.
+	if next, ok := sched.NextRun(); !ok || !next.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the next run at %s, got %s", start.Add(time.Hour), next)
+	}
+
+	// The failed repositories keep their history and are retried after
+	// CheckInterval.
+	clock.Advance(5 * time.Minute)
+	sched.Release("owner/second")
+
+	queue := sched.Queue()
+	for _, entry := range queue {
+		if entry.Link == "owner/second" && !entry.LastCheck.Equal(start.Add(-2*time.Hour)) {
+			t.Errorf("expected the last check to be kept, got %s", entry.LastCheck)
+		}
+	}
+
+	if next, ok := sched.NextRun(); !ok || !next.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected the next run at %s, got %s", start.Add(time.Hour), next)
+	}
+
+	clock.Advance(55 * time.Minute)
+
+	expected := []string{"owner/first"}
+	if res := dueLinks(sched.Due()); !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+
+	clock.Advance(5 * time.Minute)
+
+	expected = []string{"owner/second"}
+	if res := dueLinks(sched.Due()); !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestSchedulerMaxAge(t *testing.T) {
+	clock := NewFakeClock(start)
+	sched := New(clock, Options{CheckInterval: time.Hour, MaxAge: 3 * time.Hour})
+
+	sched.SetRepos([]Repo{{Link: "owner/repo", Rank: 1}})
+
+	check := func(force bool, mirrored bool) {
+		t.Helper()
+
+		tasks := sched.Due()
+		if len(tasks) != 1 || tasks[0].Force != force {
+			t.Fatalf("expected a task with force %v, got %+v", force, tasks)
+		}
+
+		sched.Done("owner/repo", mirrored)
+		clock.Advance(time.Hour)
+	}
+
+	// The HEAD moved, a new version is published.
+	check(false, true)
+	// The HEAD didn't move.
+	check(false, false)
+	check(false, false)
+	// The mirror is too old, it's published again.
+	check(true, true)
+	// The new version resets the age.
+	check(false, false)
+}
+
+func TestSchedulerSetRepos(t *testing.T) {
+	clock := NewFakeClock(start)
+	sched := New(clock, Options{CheckInterval: time.Hour})
+
+	sched.SetRepos([]Repo{{Link: "owner/first", Rank: 1}, {Link: "owner/second", Rank: 2}})
+	sched.Due()
+
+	// The running repositories are kept until they are done.
+	sched.SetRepos([]Repo{{Link: "owner/first", Rank: 2}})
+
+	if res := queueLinks(sched.Queue()); !reflect.DeepEqual(res, []string{"owner/first", "owner/second"}) {
+		t.Errorf("expected the running repositories to be kept, got %v", res)
+	}
+
+	sched.Done("owner/first", true)
+	sched.Done("owner/second", true)
+
+	sched.SetRepos([]Repo{{Link: "owner/first", Rank: 2}, {Link: "owner/new", Rank: 1}})
+
+	queue := sched.Queue()
+	if res := queueLinks(queue); !reflect.DeepEqual(res, []string{"owner/new", "owner/first"}) {
+		t.Fatalf("expected the delisted repository to be removed, got %v", res)
+	}
+
+	// The history of the repositories already scheduled is kept with their
+	// new rank.
+	if queue[1].Rank != 2 || !queue[1].LastCheck.Equal(start) {
+		t.Errorf("unexpected entry: %+v", queue[1])
+	}
+}
@@ -0,0 +1,267 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Peltoche/ipfs-gh1000/internal/fsutil"
+)
+
+const (
+	// StagePending is the stage of the queued repositories which are not
+	// started yet.
+	StagePending = "pending"
+	// StageDone is the stage of the repositories successfully processed.
+	StageDone = "done"
+	// StageQuarantined is the stage of the repositories which failed too
+	// many times.
+	StageQuarantined = "quarantined"
+)
+
+// RepoState is the progress of a repository.
+type RepoState struct {
+	Link string `json:"link"`
+	// RepoURL and Depth are only set for the submodules, they are required
+	// to queue them again as they are not listed by the ranking source.
+	RepoURL string `json:"repoURL,omitempty"`
+	Depth   int    `json:"depth,omitempty"`
+
+	// Order is the position of the repository inside the queue, it keeps
+	// the order of the pending repositories between two runs.
+	Order int `json:"order"`
+
+	Stage       string    `json:"stage"`
+	Attempts    int       `json:"attempts"` // failed attempts since the last success
+	LastError   string    `json:"lastError,omitempty"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+}
+
+// Pending returns true if the repository was queued but not completed.
+func (r *RepoState) Pending() bool {
+	return r.Stage != StageDone && r.Stage != StageQuarantined
+}
+
+// Quarantined returns true if the repository is quarantined.
+func (r *RepoState) Quarantined() bool {
+	return r.Stage == StageQuarantined
+}
+
+// Store persists the progress of each repository into a JSON file, allowing
+// a restarted daemon to resume the pending work.
+//
+// The queue changes, failures and successes are saved immediately, the file
+// is replaced atomically so a crash never leaves it corrupted. The stage
+// transitions are frequent and only useful while the daemon runs, they are
+// kept in memory and saved with the next change.
+type Store struct {
+	path string
+
+	lock      sync.Mutex
+	repos     map[string]*RepoState
+	nextOrder int
+}
+
+// Open loads the store saved at path, an empty store is created if the file
+// doesn't exist.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		repos: map[string]*RepoState{},
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the state file %q: %w", path, err)
+	}
+
+	repos := []*RepoState{}
+	err = json.Unmarshal(raw, &repos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the state file %q: %w", path, err)
+	}
+
+	for _, repo := range repos {
+		s.repos[repo.Link] = repo
+
+		if repo.Order >= s.nextOrder {
+			s.nextOrder = repo.Order + 1
+		}
+	}
+
+	return s, nil
+}
+
+// Get returns a copy of the state of the given repository.
+func (s *Store) Get(link string) (RepoState, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	repo, ok := s.repos[link]
+	if !ok {
+		return RepoState{}, false
+	}
+
+	return *repo, true
+}
+
+// Pending returns the repositories queued but not completed, in their queue
+// order.
+func (s *Store) Pending() []RepoState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := []RepoState{}
+	for _, repo := range s.repos {
+		if repo.Pending() {
+			res = append(res, *repo)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Order < res[j].Order
+	})
+
+	return res
+}
+
+// Enqueue marks the given repositories as pending, at the end of the queue.
+// The repositories already pending keep their position and the quarantined
+// ones get a new set of attempts.
+func (s *Store) Enqueue(repos ...RepoState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, repo := range repos {
+		current, ok := s.repos[repo.Link]
+		if ok && current.Pending() {
+			continue
+		}
+
+		if !ok {
+			current = &RepoState{Link: repo.Link}
+			s.repos[repo.Link] = current
+		}
+
+		if current.Quarantined() {
+			current.Attempts = 0
+		}
+
+		current.RepoURL = repo.RepoURL
+		current.Depth = repo.Depth
+		current.Order = s.nextOrder
+		current.Stage = StagePending
+		s.nextOrder++
+	}
+
+	return s.save()
+}
+
+// SetStage records the stage started by a repository. It's not saved until
+// the next change: after a crash, the repository is still pending at its
+// previous stage.
+func (s *Store) SetStage(link string, stage string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	repo, ok := s.repos[link]
+	if !ok {
+		return fmt.Errorf("unknown repository %q", link)
+	}
+
+	repo.Stage = stage
+	repo.LastAttempt = time.Now()
+
+	return nil
+}
+
+// Fail records a failed attempt and returns the number of failed attempts
+// since the last success. The repository stays pending at the stage where it
+// failed.
+func (s *Store) Fail(link string, cause error) (int, error) {
+	attempts := 0
+
+	err := s.update(link, func(repo *RepoState) {
+		repo.Attempts++
+		repo.LastError = cause.Error()
+		attempts = repo.Attempts
+	})
+
+	return attempts, err
+}
+
+// Quarantine marks a repository as quarantined, it's not pending anymore
+// until it's queued again.
+func (s *Store) Quarantine(link string) error {
+	return s.update(link, func(repo *RepoState) {
+		repo.Stage = StageQuarantined
+	})
+}
+
+// Succeed marks the given repositories as done.
+func (s *Store) Succeed(links ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	for _, link := range links {
+		repo, ok := s.repos[link]
+		if !ok {
+			return fmt.Errorf("unknown repository %q", link)
+		}
+
+		repo.Stage = StageDone
+		repo.Attempts = 0
+		repo.LastError = ""
+		repo.LastSuccess = now
+	}
+
+	return s.save()
+}
+
+func (s *Store) update(link string, fn func(repo *RepoState)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	repo, ok := s.repos[link]
+	if !ok {
+		return fmt.Errorf("unknown repository %q", link)
+	}
+
+	fn(repo)
+
+	return s.save()
+}
+
+// save writes the whole store, the lock must be held.
+func (s *Store) save() error {
+	repos := make([]*RepoState, 0, len(s.repos))
+	for _, repo := range s.repos {
+		repos = append(repos, repo)
+	}
+
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Link < repos[j].Link
+	})
+
+	raw, err := json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the state: %w", err)
+	}
+
+	err = fsutil.WriteFileAtomic(s.path, raw)
+	if err != nil {
+		return fmt.Errorf("failed to write the state file %q: %w", s.path, err)
+	}
+
+	return nil
+}
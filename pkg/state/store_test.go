@@ -0,0 +1,66 @@
+package state
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreSaveStages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Enqueue(RepoState{Link: "torvalds/linux"}, RepoState{Link: "golang/go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetStage("torvalds/linux", "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stage isn't saved yet.
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if repo, _ := reopened.Get("torvalds/linux"); repo.Stage != StagePending {
+		t.Errorf("expected the saved stage to be %q, got %q", StagePending, repo.Stage)
+	}
+
+	if repo, _ := s.Get("torvalds/linux"); repo.Stage != "fetch" || repo.LastAttempt.IsZero() {
+		t.Errorf("expected the fetch stage in memory, got %+v", repo)
+	}
+
+	// It's saved with the next change.
+	_, err = s.Fail("torvalds/linux", errors.New("connection reset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, _ := reopened.Get("torvalds/linux")
+	if repo.Stage != "fetch" || repo.Attempts != 1 || repo.LastError != "connection reset" || repo.LastAttempt.IsZero() {
+		t.Errorf("unexpected saved state %+v", repo)
+	}
+
+	pending := reopened.Pending()
+	if len(pending) != 2 || pending[0].Link != "torvalds/linux" || pending[1].Link != "golang/go" {
+		t.Errorf("expected the queue order to be kept, got %+v", pending)
+	}
+
+	err = s.SetStage("unknown/repo", "fetch")
+	if err == nil {
+		t.Errorf("expected an error for an unknown repository")
+	}
+}
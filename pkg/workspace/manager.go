@@ -0,0 +1,95 @@
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+)
+
+const dirPrefix = "repo-"
+
+// Workspace is the scratch filesystem used to build a single repository.
+type Workspace struct {
+	FS  billy.Filesystem
+	dir string
+}
+
+// OnDisk returns true if the workspace is backed by the disk.
+func (w *Workspace) OnDisk() bool {
+	return w.dir != ""
+}
+
+// Close removes all the workspace content.
+func (w *Workspace) Close() error {
+	if w.dir == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to remove the workspace %q: %w", w.dir, err)
+	}
+
+	return nil
+}
+
+// Manager creates the workspaces.
+//
+// The repositories are built in memory if their expected size is known and
+// below memoryLimit, otherwise they are built inside a directory under root.
+type Manager struct {
+	root        string
+	memoryLimit int64
+}
+
+func NewManager(root string, memoryLimit int64) (*Manager, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the workspace root %q: %w", root, err)
+	}
+
+	return &Manager{root, memoryLimit}, nil
+}
+
+// Create a new workspace for the repository name. expectedSize is the
+// repository size in bytes, 0 if unknown.
+func (m *Manager) Create(name string, expectedSize int64) (*Workspace, error) {
+	if expectedSize > 0 && expectedSize <= m.memoryLimit {
+		return &Workspace{FS: memfs.New()}, nil
+	}
+
+	safeName := strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+
+	dir, err := os.MkdirTemp(m.root, dirPrefix+safeName+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the workspace dir: %w", err)
+	}
+
+	return &Workspace{FS: osfs.New(dir), dir: dir}, nil
+}
+
+// Prune removes the workspaces left by a previous process.
+func (m *Manager) Prune() error {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return fmt.Errorf("failed to list the workspaces: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), dirPrefix) {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(m.root, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to remove the workspace %q: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/util"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := []string{}
+	for _, entry := range entries {
+		res = append(res, entry.Name())
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+func TestManagerCreate(t *testing.T) {
+	root := t.TempDir()
+
+	m, err := NewManager(root, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expectedSize int64
+		onDisk       bool
+	}{
+		{expectedSize: 0, onDisk: true}, // unknown size
+		{expectedSize: 512, onDisk: false},
+		{expectedSize: 1024, onDisk: false},
+		{expectedSize: 2048, onDisk: true},
+	}
+
+	for _, test := range tests {
+		ws, err := m.Create("owner/repo", test.expectedSize)
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %s", test.expectedSize, err)
+		}
+
+		if ws.OnDisk() != test.onDisk {
+			t.Errorf("size %d: expected on disk %v, got %v", test.expectedSize, test.onDisk, ws.OnDisk())
+		}
+
+		err = util.WriteFile(ws.FS, "objects/info/packs", []byte("P pack-1.pack\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.onDisk {
+			_, err = os.Stat(filepath.Join(ws.dir, "objects", "info", "packs"))
+			if err != nil {
+				t.Errorf("size %d: expected the file on disk: %s", test.expectedSize, err)
+			}
+		}
+
+		err = ws.Close()
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %s", test.expectedSize, err)
+		}
+	}
+
+	// Every workspace is removed once closed.
+	if entries := listDir(t, root); len(entries) != 0 {
+		t.Errorf("expected no workspace left, got %v", entries)
+	}
+}
+
+func TestManagerCreateSameRepository(t *testing.T) {
+	root := t.TempDir()
+
+	m, err := NewManager(root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two builds of the same repository never share a directory.
+	first, err := m.Create("owner/repo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := m.Create("owner/repo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.dir == second.dir {
+		t.Fatalf("expected two directories, got %q twice", first.dir)
+	}
+
+	// A failed build closes its workspace without touching the other one.
+	err = util.WriteFile(first.FS, "HEAD", []byte("ref: refs/heads/master\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = first.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	entries := listDir(t, root)
+	if len(entries) != 1 || entries[0] != filepath.Base(second.dir) {
+		t.Errorf("expected only the second workspace, got %v", entries)
+	}
+
+	// Closing twice is harmless.
+	err = first.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestManagerPrune(t *testing.T) {
+	root := t.TempDir()
+
+	m, err := NewManager(root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The workspaces left by a crashed process.
+	for _, name := range []string{"owner/first", "owner/second"} {
+		ws, err := m.Create(name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = util.WriteFile(ws.FS, "HEAD", []byte("ref: refs/heads/master\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(root, "state.json"), []byte("[]"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Mkdir(filepath.Join(root, "cache"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Prune()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{"cache", "state.json"}
+	if entries := listDir(t, root); len(entries) != 2 || entries[0] != expected[0] || entries[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+}